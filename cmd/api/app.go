@@ -3,12 +3,21 @@ package main
 import (
 	"html/template"
 	"trisend/internal/db"
+	"trisend/internal/limiter"
+	"trisend/internal/notify"
 	"trisend/internal/services"
+	"trisend/internal/tunnel"
 )
 
 type App struct {
 	Auth             services.AuthService
 	UserStore        db.UserStore
+	Transfers        db.TransferStore
+	Notifier         *notify.Notifier
 	SessionStore     db.SessionStore
 	AuthCodeTemplate *template.Template
+	PasswordAttempts *limiter.Passwords
+	Registry         tunnel.Registry
+	// Stopping is closed once the server starts shutting down
+	Stopping <-chan struct{}
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"trisend/internal/types"
+	"trisend/internal/views"
+	"trisend/internal/views/components"
+)
+
+func handleTransfersView(app App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(SESSION_COOKIE).(*types.Session)
+
+		transfers, err := app.Transfers.GetTransfers(r.Context(), user.ID)
+		if err != nil {
+			slog.Error(err.Error())
+			http.Error(w, "Failed to get transfers", http.StatusInternalServerError)
+			return
+		}
+
+		// only the registry knows whether a link can still be downloaded
+		active := map[string]bool{}
+		for _, transfer := range transfers {
+			if transfer.Revoked {
+				continue
+			}
+			_, active[transfer.ID] = app.Registry.GetStreamDetails(transfer.ID)
+		}
+
+		profile := components.ProfileButton(user)
+		views.Transfers(profile, transfers, active).Render(r.Context(), w)
+	}
+}
+
+func handleRevokeTransfer(app App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(SESSION_COOKIE).(*types.Session)
+		id := r.PathValue("id")
+
+		transfer, err := app.Transfers.GetTransfer(r.Context(), id)
+		if err != nil {
+			slog.Error(err.Error())
+			http.Error(w, "Unable to revoke transfer", http.StatusInternalServerError)
+			return
+		}
+		if transfer == nil || transfer.UserID != user.ID {
+			http.NotFound(w, r)
+			return
+		}
+
+		if details, ok := app.Registry.GetStreamDetails(id); ok {
+			// the sender is connected to another instance
+			if !app.Registry.IsLocal(id) {
+				forwardToNode(w, r, details)
+				return
+			}
+			app.Registry.DeleteStream(id)
+		}
+
+		if err := app.Transfers.RevokeTransfer(r.Context(), id); err != nil {
+			slog.Error(err.Error())
+			http.Error(w, "Unable to revoke transfer", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("HX-Refresh", "true")
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"trisend/internal/tunnel"
+	"trisend/internal/types"
+	"trisend/internal/views"
+	"trisend/internal/views/components"
+)
+
+func handleInboxView(app App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(SESSION_COOKIE).(*types.Session)
+
+		ids, err := app.Transfers.GetInbox(r.Context(), user.ID)
+		if err != nil {
+			slog.Error(err.Error())
+			http.Error(w, "Failed to get inbox", http.StatusInternalServerError)
+			return
+		}
+
+		// transfers that were revoked or downloaded as often as allowed
+		// are gone from the registry before they expire
+		pending := make([]*tunnel.StreamDetails, 0, len(ids))
+		for _, id := range ids {
+			if details, ok := app.Registry.GetStreamDetails(id); ok {
+				pending = append(pending, details)
+			}
+		}
+
+		profile := components.ProfileButton(user)
+		views.Inbox(profile, pending).Render(r.Context(), w)
+	}
+}
+
+// handleAcceptTransfer takes the transfer out of the inbox and leads to its
+// download page.
+func handleAcceptTransfer(app App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(SESSION_COOKIE).(*types.Session)
+		id := r.PathValue("id")
+
+		if err := app.Transfers.RemoveFromInbox(r.Context(), user.ID, id); err != nil {
+			slog.Error(err.Error())
+			http.Error(w, "Unable to accept transfer", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("HX-Redirect", "/download/"+id)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// handleDeclineTransfer takes the transfer out of the inbox. The link is
+// revoked when nobody else was meant to receive it, so the sender stops
+// waiting.
+func handleDeclineTransfer(app App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(SESSION_COOKIE).(*types.Session)
+		id := r.PathValue("id")
+
+		if err := app.Transfers.RemoveFromInbox(r.Context(), user.ID, id); err != nil {
+			slog.Error(err.Error())
+			http.Error(w, "Unable to decline transfer", http.StatusInternalServerError)
+			return
+		}
+
+		details, ok := app.Registry.GetStreamDetails(id)
+		if ok && onlyRecipient(details, user) {
+			// the sender is connected to another instance
+			if !app.Registry.IsLocal(id) {
+				forwardToNode(w, r, details)
+				return
+			}
+			app.Registry.DeleteStream(id)
+
+			if err := app.Transfers.RevokeTransfer(r.Context(), id); err != nil {
+				slog.Error(err.Error())
+			}
+		}
+
+		w.Header().Set("HX-Refresh", "true")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// onlyRecipient reports whether user is the single recipient of the transfer.
+func onlyRecipient(details *tunnel.StreamDetails, user *types.Session) bool {
+	if len(details.Recipients) != 1 {
+		return false
+	}
+
+	recipient := details.Recipients[0]
+	return strings.EqualFold(recipient, user.Username) || strings.EqualFold(recipient, user.Email)
+}
@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
 	_ "embed"
 	"log/slog"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 	"trisend/internal/config"
 	"trisend/internal/db"
+	"trisend/internal/limiter"
+	"trisend/internal/notify"
 	"trisend/internal/server"
 	"trisend/internal/services"
+	"trisend/internal/storage"
+	"trisend/internal/tunnel"
 
 	"github.com/gorilla/sessions"
 	"github.com/joho/godotenv"
@@ -51,16 +60,62 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := db.MigrateUsernames(context.Background(), redisDB); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	store, err := storage.NewStorage()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	var registry tunnel.Registry = tunnel.NewMemoryRegistry(store)
+	if config.NODE_URL != "" {
+		registry = tunnel.NewRedisRegistry(store, redisDB, config.NODE_URL)
+	}
+
+	server := server.NewWebServer(registry)
+
+	// every client gets 5 guesses on a link, and all of them together 20,
+	// shared by the instances through Redis
+	passwordAttempts := limiter.NewPasswords(
+		limiter.NewRedisLimiter(redisDB, "attempts:client", 5, time.Minute*15),
+		limiter.NewRedisLimiter(redisDB, "attempts:transfer", 20, time.Minute*15),
+	)
+
 	userStore := db.NewUserRedisStore(redisDB)
+	transferStore := db.NewTransferRedisStore(redisDB)
+
+	notifier, err := notify.NewNotifier(userStore, transferStore, filepath.Join("templates", "transferNotification.html"))
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	registry.OnDelete(notifier.Expired)
+
 	app := App{
 		Auth:         services.NewAuthService(userStore),
 		UserStore:    userStore,
+		Transfers:    transferStore,
+		Notifier:     notifier,
 		SessionStore: db.NewRedisSessionStore(redisDB),
+
+		PasswordAttempts: passwordAttempts,
+		Registry:         registry,
+		Stopping:         server.Stopping(),
 	}
 
-	server := server.NewWebServer()
 	router := AddRoutes(app)
-	server.SetupConfig(router, privateKey, userStore)
+	server.SetupConfig(router, privateKey, userStore, transferStore, notifier, passwordAttempts)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	server.ListenAndServe()
+	err = server.ListenAndServe(ctx)
+	notifier.Wait()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
 }
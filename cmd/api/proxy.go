@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+	"trisend/internal/config"
+	"trisend/internal/tunnel"
+)
+
+// forwardToNode proxies a download to the instance the sender of the
+// transfer is connected to.
+func forwardToNode(w http.ResponseWriter, r *http.Request, details *tunnel.StreamDetails) {
+	if details.Node == "" || r.Header.Get(tunnel.ForwardedHeader) != "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !config.IsKnownNode(details.Node) {
+		slog.Error("transfer of an unknown instance", "id", details.ID, "node", details.Node)
+		http.NotFound(w, r)
+		return
+	}
+
+	target, err := url.Parse(details.Node)
+	if err != nil {
+		slog.Error(err.Error())
+		http.Error(w, "Unable to reach the sender", http.StatusBadGateway)
+		return
+	}
+
+	// the download lasts as long as the upload, longer than the write
+	// timeout of the server
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		slog.Error(err.Error())
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.FlushInterval = -1
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		slog.Error(err.Error())
+		http.Error(w, "Unable to reach the sender", http.StatusBadGateway)
+	}
+
+	r.Header.Set(tunnel.ForwardedHeader, config.NODE_URL)
+	proxy.ServeHTTP(w, r)
+}
@@ -28,8 +28,20 @@ func AddRoutes(app App) *http.ServeMux {
 	handler.Handle("GET /keys/create", WithAuth(handleCreateKeyView()))
 	handler.Handle("DELETE /keys/{id}", WithAuth(handleDeleteKey(app)))
 
-	handler.HandleFunc("GET /download/{id}", WithAuth(handleDownloadPage))
-	handler.HandleFunc("GET /download/direct/{id}", WithAuth(handleTransferFiles))
+	handler.Handle("GET /transfers", WithAuth(handleTransfersView(app)))
+	handler.Handle("DELETE /transfers/{id}", WithAuth(handleRevokeTransfer(app)))
+
+	handler.Handle("GET /inbox", WithAuth(handleInboxView(app)))
+	handler.Handle("POST /inbox/{id}/accept", WithAuth(handleAcceptTransfer(app)))
+	handler.Handle("DELETE /inbox/{id}", WithAuth(handleDeclineTransfer(app)))
+
+	handler.Handle("GET /settings", WithAuth(handleSettingsView(app)))
+	handler.Handle("POST /settings", WithAuth(handleUpdateSettings(app)))
+
+	handler.Handle("GET /download/{id}", handleDownloadPage(app))
+	handler.Handle("GET /download/events/{id}", handleTransferEvents(app))
+	handler.Handle("POST /download/{id}/unlock", handleUnlockDownload(app))
+	handler.Handle("GET /download/direct/{id}", handleTransferFiles(app))
 
 	return handler
 }
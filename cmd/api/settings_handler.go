@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"trisend/internal/types"
+	"trisend/internal/views"
+	"trisend/internal/views/components"
+)
+
+func handleSettingsView(app App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(SESSION_COOKIE).(*types.Session)
+
+		notifications, err := app.UserStore.GetNotifications(r.Context(), user.ID)
+		if err != nil {
+			slog.Error(err.Error())
+			http.Error(w, "Failed to get settings", http.StatusInternalServerError)
+			return
+		}
+
+		profile := components.ProfileButton(user)
+		views.Settings(profile, *notifications).Render(r.Context(), w)
+	}
+}
+
+func handleUpdateSettings(app App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(SESSION_COOKIE).(*types.Session)
+
+		// unchecked boxes are not sent with the form
+		notifications := types.Notifications{
+			FirstDownload: r.FormValue("first_download") == "on",
+			EveryDownload: r.FormValue("every_download") == "on",
+			Expired:       r.FormValue("expired") == "on",
+			Inbox:         r.FormValue("inbox") == "on",
+		}
+
+		if err := app.UserStore.SetNotifications(r.Context(), user.ID, notifications); err != nil {
+			slog.Error(err.Error())
+			http.Error(w, "Unable to save settings", http.StatusInternalServerError)
+			return
+		}
+
+		views.NotificationsForm(notifications, true).Render(r.Context(), w)
+	}
+}
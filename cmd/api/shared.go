@@ -4,7 +4,9 @@ import (
 	"net/http"
 	"trisend/internal/types"
 	"trisend/internal/util"
+	"trisend/internal/views/components"
 
+	"github.com/a-h/templ"
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -31,3 +33,12 @@ func getUserFromCookie(r *http.Request) *types.Session {
 		Pfp:      claims["pfp"].(string),
 	}
 }
+
+// profileButton renders the account menu, or a login button for visitors.
+func profileButton(user *types.Session) templ.Component {
+	if user == nil {
+		return components.LoginButton()
+	}
+
+	return components.ProfileButton(user)
+}
@@ -1,55 +1,546 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"strings"
+	"time"
+	"trisend/internal/archive"
+	"trisend/internal/config"
+	"trisend/internal/storage"
 	"trisend/internal/tunnel"
 	"trisend/internal/types"
+	"trisend/internal/util"
 	"trisend/internal/views"
-	"trisend/internal/views/components"
+
+	"github.com/a-h/templ"
+	"github.com/golang-jwt/jwt/v5"
 )
 
-func handleDownloadPage(w http.ResponseWriter, r *http.Request) {
-	value := r.Context().Value(SESSION_COOKIE)
-	user := value.(*types.Session)
+func handleDownloadPage(app App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := getUserFromCookie(r)
+
+		id := r.PathValue("id")
+		details, ok := app.Registry.GetStreamDetails(id)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			views.NotFound(user).Render(r.Context(), w)
+			return
+		}
+		if !authorizeDownload(w, r, user, details) {
+			return
+		}
+
+		url := fmt.Sprintf("%s/download/direct/%s", r.URL.Hostname(), id)
+
+		unlocked := isUnlocked(r, id)
+		views.Download(id, details, url, profileButton(user), unlocked).Render(r.Context(), w)
+	}
+}
+
+// handleTransferEvents streams the status of a transfer to the download
+// page with Server-Sent Events.
+func handleTransferEvents(app App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := getUserFromCookie(r)
+
+		id := r.PathValue("id")
+		details, ok := app.Registry.GetStreamDetails(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if !authorizeDownload(w, r, user, details) {
+			return
+		}
+
+		events, unsubscribe, ok := app.Registry.Subscribe(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		defer unsubscribe()
+
+		// the stream stays open until the transfer is gone, longer than the
+		// write timeout of the server
+		controller := http.NewResponseController(w)
+		if err := controller.SetWriteDeadline(time.Time{}); err != nil {
+			slog.Error(err.Error())
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		controller.Flush()
+
+		expired := time.NewTimer(time.Until(details.Expires))
+		defer expired.Stop()
+
+		last := *details
+		for {
+			select {
+			case current, ok := <-events:
+				if ok {
+					last = current
+				}
+				if ok && last.Status != tunnel.StatusExpired {
+					writeEvent(w, r, "status", views.TransferStatus(id, &last))
+					controller.Flush()
+					continue
+				}
+			case <-expired.C:
+			case <-r.Context().Done():
+				return
+			case <-app.Stopping:
+				// the browser reconnects once the server is back
+				return
+			}
+
+			last.Status = tunnel.StatusExpired
+			writeEvent(w, r, "expired", views.TransferStatus(id, &last))
+			controller.Flush()
+			return
+		}
+	}
+}
+
+// writeEvent renders a component as the data of a Server-Sent Event, every
+// line of the data needs its own prefix.
+func writeEvent(w http.ResponseWriter, r *http.Request, event string, component templ.Component) {
+	html := new(strings.Builder)
+	if err := component.Render(r.Context(), html); err != nil {
+		slog.Error(err.Error())
+		return
+	}
+
+	fmt.Fprintf(w, "event: %s\n", event)
+	for _, line := range strings.Split(html.String(), "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+func handleUnlockDownload(app App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		details, ok := app.Registry.GetStreamDetails(id)
+		if !ok {
+			w.Header().Set("HX-Refresh", "true")
+			return
+		}
+		if details.Visibility != tunnel.VisibilityPassword {
+			w.Header().Set("HX-Redirect", "/download/"+id)
+			return
+		}
+
+		// the attempt is counted before the slow password check, so parallel
+		// guesses can not all get through before the first one fails
+		client := clientAddress(r)
+		allowed, err := app.PasswordAttempts.Reserve(r.Context(), id, client)
+		if err != nil {
+			slog.Error(err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			views.PasswordForm(id, fmt.Errorf("Too many attempts, try it later")).Render(r.Context(), w)
+			return
+		}
+
+		if !details.CheckPassword(r.FormValue("password")) {
+			views.PasswordForm(id, fmt.Errorf("Invalid password")).Render(r.Context(), w)
+			return
+		}
+		if err := app.PasswordAttempts.Succeeded(r.Context(), id, client); err != nil {
+			slog.Error(err.Error())
+		}
+
+		token, err := util.CreateDownloadToken(id, details.Expires)
+		if err != nil {
+			slog.Error(err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     util.DOWNLOAD_COOKIE + id,
+			Value:    token,
+			Path:     "/download/",
+			HttpOnly: true,
+			Secure:   config.IsAppEnvProd(),
+			SameSite: http.SameSiteLaxMode,
+			Expires:  details.Expires,
+		})
+		w.Header().Set("HX-Redirect", "/download/"+id)
+	}
+}
+
+// clientAddress returns the address of the client, behind a trusted proxy
+// it is the last one the proxy added to X-Forwarded-For.
+func clientAddress(r *http.Request) string {
+	if config.TRUST_PROXY {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if last := strings.TrimSpace(forwarded[len(forwarded)-1]); last != "" {
+			return last
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// isUnlocked reports whether the request carries a token granted after
+// entering the password of the transfer.
+func isUnlocked(r *http.Request, id string) bool {
+	return downloadClaims(r, id) != nil
+}
+
+// downloadClaims returns the claims of the download token of the transfer,
+// nil when the request does not carry a valid one.
+func downloadClaims(r *http.Request, id string) jwt.MapClaims {
+	cookie, err := r.Cookie(util.DOWNLOAD_COOKIE + id)
+	if err != nil {
+		return nil
+	}
+
+	token, err := util.ParseToken(cookie.Value)
+	if err != nil {
+		return nil
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["download"] != id {
+		return nil
+	}
+
+	return claims
+}
+
+// getDownloadUser returns the logged in user, or the recipient another
+// instance forwarded the download of the transfer for.
+func getDownloadUser(r *http.Request, id string) *types.Session {
+	if user := getUserFromCookie(r); user != nil {
+		return user
+	}
+
+	claims := downloadClaims(r, id)
+	username, _ := claims["username"].(string)
+	if username == "" {
+		return nil
+	}
+	userID, _ := claims["id"].(string)
+	email, _ := claims["email"].(string)
+
+	return &types.Session{ID: userID, Username: username, Email: email}
+}
+
+// authorizeDownload checks whether the request can access the transfer,
+// otherwise it writes the response and returns false.
+func authorizeDownload(w http.ResponseWriter, r *http.Request, user *types.Session, details *tunnel.StreamDetails) bool {
+	if !details.RequiresAccount() {
+		return true
+	}
+
+	if user == nil {
+		redirectToLogin(w, r)
+		return false
+	}
+
+	if !details.CanDownload(user.Username, user.Email) {
+		w.WriteHeader(http.StatusForbidden)
+		views.Forbidden(user).Render(r.Context(), w)
+		return false
+	}
+
+	return true
+}
+
+func handleTransferFiles(app App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		user := getDownloadUser(r, id)
+
+		details, ok := app.Registry.GetStreamDetails(id)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			views.NotFound(user).Render(r.Context(), w)
+			return
+		}
+		if !authorizeDownload(w, r, user, details) {
+			return
+		}
+		if details.Visibility == tunnel.VisibilityPassword && !isUnlocked(r, id) {
+			http.Redirect(w, r, "/download/"+id, http.StatusSeeOther)
+			return
+		}
+
+		// the sender is connected to another instance
+		if !app.Registry.IsLocal(id) {
+			forwardToNode(w, r, details)
+			return
+		}
+
+		if _, ok := app.Registry.GetSpool(id); ok {
+			serveSpool(w, r, app, id)
+			return
+		}
+
+		// validated before taking the stream, a bad request must not hold
+		// on to the sender
+		format := archive.Zip
+		if value := r.URL.Query().Get("format"); value != "" {
+			parsed, err := archive.ParseFormat(value)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			format = parsed
+		}
+
+		// waiting for the sender and the relayed upload last longer than the
+		// write timeout of the server
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+			slog.Error(err.Error())
+		}
 
-	id := r.PathValue("id")
-	details, ok := tunnel.GetStreamDetails(id)
-	if !ok {
-		views.NotFound(user).Render(r.Context(), w)
+		// the first recipient starts the upload, everyone else waits for it
+		channel, err := app.Registry.WaitStream(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, tunnel.ErrExpired) {
+				views.NotFound(user).Render(r.Context(), w)
+			}
+			return
+		} else if channel == nil {
+			serveSpool(w, r, app, id)
+			return
+		}
+
+		done := make(chan struct{})
+		Error := make(chan struct{})
+
+		// the sender may write the upload straight into the response
+		// instead of spooling it first
+		var relayed *tunnel.Spool
+		relay := func(spool *tunnel.Spool) io.Writer {
+			relayed = spool
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", spool.Filename))
+			w.Header().Set("Content-Type", spool.ContentType)
+			// the checksum is only known once everything was relayed
+			w.Header().Set("Trailer", "Digest, X-Checksum-Sha256")
+			w.WriteHeader(http.StatusOK)
+			return w
+		}
+
+		select {
+		case channel <- tunnel.Stream{Done: done, Error: Error, Format: format, Relay: relay}:
+		case <-time.After(time.Until(details.Expires)):
+			views.NotFound(user).Render(r.Context(), w)
+			return
+		case <-r.Context().Done():
+			// the next recipient starts the upload instead
+			app.Registry.ReturnStream(id, channel)
+			return
+		}
+
+		select {
+		case <-done:
+		case <-Error:
+			if relayed == nil {
+				views.NotFound(user).Render(r.Context(), w)
+			}
+			return
+		}
+
+		if relayed != nil {
+			setChecksum(w, relayed.Checksum)
+			recordDownload(app, r, id)
+			return
+		}
+		serveSpool(w, r, app, id)
+	}
+}
+
+// serveSpool writes a spooled upload honoring Range and If-Range headers,
+// so interrupted downloads can be resumed until the link expires.
+func serveSpool(w http.ResponseWriter, r *http.Request, app App, id string) {
+	object, spool, err := app.Registry.OpenSpool(r.Context(), id)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		slog.Error(err.Error())
+		http.Error(w, "Unable to read file", http.StatusInternalServerError)
 		return
 	}
+	defer object.Close()
+
+	// large files take longer than the write timeout of the server
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		slog.Error(err.Error())
+	}
+
+	if value := r.URL.Query().Get("format"); value != "" {
+		format, err := archive.ParseFormat(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if format != spool.Format {
+			serveConverted(w, r, app, id, object, spool, format)
+			return
+		}
+	}
+
+	w.Header().Set("ETag", spoolETag(object, spool))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", spool.Filename))
+	w.Header().Set("Content-Type", spool.ContentType)
+	setChecksum(w, spool.Checksum)
 
-	url := fmt.Sprintf("%s/download/direct/%s", r.URL.Hostname(), id)
+	writer := &downloadWriter{ResponseWriter: w}
+	http.ServeContent(writer, r, spool.Filename, object.ModTime(), object)
 
-	profileBtn := components.ProfileButton(user)
-	views.Download(details, url, profileBtn).Render(r.Context(), w)
+	if r.Method == http.MethodGet && writer.completed(object.Size()) {
+		app.Registry.CompleteDownload(id)
+		recordDownload(app, r, id)
+	}
 }
 
-func handleTransferFiles(w http.ResponseWriter, r *http.Request) {
-	id := r.PathValue("id")
-	value := r.Context().Value(SESSION_COOKIE)
-	user := value.(*types.Session)
+// spoolETag identifies the content of a spool, so a resumed download is
+// never stitched from two uploads. Spools without a checksum fall back on
+// their size and modification time.
+func spoolETag(object storage.Object, spool *tunnel.Spool) string {
+	if spool.Checksum != "" {
+		return fmt.Sprintf("%q", spool.Checksum)
+	}
+
+	return fmt.Sprintf(`"%x-%x"`, object.Size(), object.ModTime().UnixNano())
+}
 
-	channel, ok := tunnel.GetStream(id)
-	if !ok {
-		views.NotFound(user).Render(r.Context(), w)
+// setChecksum publishes the SHA-256 of the spool, as the Digest header of
+// RFC 3230 and as plain hex for tools that do not decode it.
+func setChecksum(w http.ResponseWriter, checksum string) {
+	digest, err := hex.DecodeString(checksum)
+	if err != nil || len(digest) == 0 {
 		return
 	}
-	defer tunnel.DeleteStream(id)
 
-	done := make(chan struct{})
-	Error := make(chan struct{})
+	w.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(digest))
+	w.Header().Set("X-Checksum-Sha256", checksum)
+}
 
-	channel <- tunnel.Stream{
-		Writer: w,
-		Done:   done,
-		Error:  Error,
+// serveConverted streams the spool as an archive of another format. The
+// archive is built on the fly, so it can not be resumed with Range requests.
+func serveConverted(w http.ResponseWriter, r *http.Request, app App, id string, object storage.Object, spool *tunnel.Spool, format archive.Format) {
+	var src archive.Reader
+	if spool.Format == "" {
+		src = archive.SingleFile(&archive.Header{
+			Name:    spool.Filename,
+			Mode:    0o644,
+			ModTime: object.ModTime(),
+			Size:    object.Size(),
+		}, object)
+	} else {
+		reader, err := archive.NewReader(object, object.Size(), spool.Format)
+		if err != nil {
+			slog.Error(err.Error())
+			http.Error(w, "Unable to read file", http.StatusInternalServerError)
+			return
+		}
+		src = reader
 	}
+	defer src.Close()
+
+	filename := strings.TrimSuffix(spool.Filename, string(spool.Format))
+	filename = strings.TrimSuffix(filename, ".") + format.Ext()
 
-	select {
-	case <-done:
-	case <-Error:
-		views.NotFound(user).Render(r.Context(), w)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Accept-Ranges", "none")
+	if r.Method == http.MethodHead {
+		return
 	}
+
+	dst, err := archive.NewWriter(w, format)
+	if err != nil {
+		slog.Error(err.Error())
+		http.Error(w, "Unable to convert file", http.StatusInternalServerError)
+		return
+	}
+
+	if err := archive.Copy(dst, src); err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	if err := dst.Close(); err != nil {
+		slog.Error(err.Error())
+		return
+	}
+
+	app.Registry.CompleteDownload(id)
+	recordDownload(app, r, id)
+}
+
+// recordDownload adds a finished download to the history of the transfer.
+func recordDownload(app App, r *http.Request, id string) {
+	download := types.Download{At: time.Now()}
+	if user := getDownloadUser(r, id); user != nil {
+		download.Username = user.Username
+	}
+
+	// the recipient may be gone already, the download is complete anyway
+	ctx := context.WithoutCancel(r.Context())
+	if err := app.Transfers.AddDownload(ctx, id, download); err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	app.Notifier.Downloaded(id)
+}
+
+// downloadWriter keeps track of what was sent to the recipient, so only
+// downloads that reached the end of the file are counted.
+type downloadWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *downloadWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *downloadWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+
+	return n, err
+}
+
+func (w *downloadWriter) completed(size int64) bool {
+	switch w.status {
+	case http.StatusOK:
+		return w.written == size
+	case http.StatusPartialContent:
+		var start, end, total int64
+		_, err := fmt.Sscanf(w.Header().Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+		return err == nil && end == total-1 && w.written == end-start+1
+	}
+
+	return false
 }
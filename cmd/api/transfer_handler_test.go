@@ -0,0 +1,795 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"trisend/internal/config"
+	"trisend/internal/limiter"
+	"trisend/internal/tunnel"
+	"trisend/internal/tunnel/tunneltest"
+	"trisend/internal/types"
+	"trisend/internal/util"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestApp(t *testing.T) App {
+	return App{
+		Registry: tunneltest.NewRegistry(t),
+		PasswordAttempts: limiter.NewPasswords(
+			limiter.NewMemoryLimiter(5, time.Minute),
+			limiter.NewMemoryLimiter(20, time.Minute),
+		),
+		Transfers: &memoryTransfers{
+			transfers: map[string]*types.Transfer{},
+			inboxes:   map[string][]string{},
+		},
+	}
+}
+
+// memoryTransfers keeps the history of transfers and the inboxes in memory
+// for the tests.
+type memoryTransfers struct {
+	mutex     sync.Mutex
+	transfers map[string]*types.Transfer
+	inboxes   map[string][]string
+}
+
+func (m *memoryTransfers) CreateTransfer(ctx context.Context, transfer types.Transfer) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.transfers[transfer.ID] = &transfer
+	return nil
+}
+
+func (m *memoryTransfers) SetTransferSize(ctx context.Context, id string, size int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if transfer, ok := m.transfers[id]; ok {
+		transfer.Size = size
+	}
+	return nil
+}
+
+func (m *memoryTransfers) AddDownload(ctx context.Context, id string, download types.Download) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if transfer, ok := m.transfers[id]; ok {
+		transfer.Downloads = append(transfer.Downloads, download)
+	}
+	return nil
+}
+
+func (m *memoryTransfers) RevokeTransfer(ctx context.Context, id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if transfer, ok := m.transfers[id]; ok {
+		transfer.Revoked = true
+	}
+	return nil
+}
+
+func (m *memoryTransfers) GetTransfer(ctx context.Context, id string) (*types.Transfer, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	transfer, ok := m.transfers[id]
+	if !ok {
+		return nil, nil
+	}
+	copied := *transfer
+	return &copied, nil
+}
+
+func (m *memoryTransfers) GetTransfers(ctx context.Context, userID string) ([]types.Transfer, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var transfers []types.Transfer
+	for _, transfer := range m.transfers {
+		if transfer.UserID == userID {
+			transfers = append(transfers, *transfer)
+		}
+	}
+	return transfers, nil
+}
+
+func (m *memoryTransfers) AddToInbox(ctx context.Context, userID, id string, expires time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.inboxes[userID] = append(m.inboxes[userID], id)
+	return nil
+}
+
+func (m *memoryTransfers) RemoveFromInbox(ctx context.Context, userID, id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.inboxes[userID] = slices.DeleteFunc(m.inboxes[userID], func(item string) bool {
+		return item == id
+	})
+	return nil
+}
+
+func (m *memoryTransfers) GetInbox(ctx context.Context, userID string) ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return slices.Clone(m.inboxes[userID]), nil
+}
+
+func transferRequest(app App, id string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/download/direct/"+id, nil)
+	r.SetPathValue("id", id)
+	w := httptest.NewRecorder()
+	handleTransferFiles(app)(w, r)
+
+	return w
+}
+
+// helloChecksum is the SHA-256 of "hello".
+const helloChecksum = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+func TestTransferFilesServesSpool(t *testing.T) {
+	app := newTestApp(t)
+
+	app.Registry.SetStream("abc", nil, &tunnel.StreamDetails{
+		Expires:    time.Now().Add(time.Minute),
+		Visibility: tunnel.VisibilityPublic,
+	})
+	app.Transfers.CreateTransfer(context.Background(), types.Transfer{ID: "abc"})
+	err := app.Registry.StoreSpool(context.Background(), "abc", strings.NewReader("hello"), 5, &tunnel.Spool{
+		Filename:    "hello.txt",
+		ContentType: "text/plain",
+		Checksum:    helloChecksum,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := transferRequest(app, "abc")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if body, _ := io.ReadAll(w.Body); string(body) != "hello" {
+		t.Errorf("expected body hello, got %q", body)
+	}
+	if digest := w.Header().Get("Digest"); digest != "sha-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=" {
+		t.Errorf("expected the sha-256 digest of hello, got %q", digest)
+	}
+
+	// the only download retires the transfer
+	if _, ok := app.Registry.GetStreamDetails("abc"); ok {
+		t.Error("expected transfer to be retired after its download")
+	}
+
+	transfer, _ := app.Transfers.GetTransfer(context.Background(), "abc")
+	if len(transfer.Downloads) != 1 || transfer.Downloads[0].Username != "" {
+		t.Errorf("expected one anonymous download in the history, got %v", transfer.Downloads)
+	}
+}
+
+func TestTransferFilesAcceptsNodeToken(t *testing.T) {
+	secret := config.JWT_SECRET
+	t.Cleanup(func() { config.JWT_SECRET = secret })
+	config.JWT_SECRET = "test"
+
+	app := newTestApp(t)
+	for _, id := range []string{"abc", "xyz"} {
+		app.Registry.SetStream(id, nil, &tunnel.StreamDetails{
+			Expires:      time.Now().Add(time.Minute),
+			Visibility:   tunnel.VisibilityPrivate,
+			Recipients:   []string{"bob"},
+			MaxDownloads: 1,
+		})
+		app.Transfers.CreateTransfer(context.Background(), types.Transfer{ID: id})
+		err := app.Registry.StoreSpool(context.Background(), id, strings.NewReader("hello"), 5, &tunnel.Spool{Filename: "hello.txt"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	token, err := util.CreateNodeToken("abc", types.Session{ID: "1", Username: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarded := func(id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/download/direct/"+id, nil)
+		r.SetPathValue("id", id)
+		r.AddCookie(&http.Cookie{Name: util.DOWNLOAD_COOKIE + id, Value: token})
+		w := httptest.NewRecorder()
+		handleTransferFiles(app)(w, r)
+		return w
+	}
+
+	// the token is scoped to the transfer it was minted for
+	if w := forwarded("xyz"); w.Code == http.StatusOK {
+		t.Error("expected the token of abc to be refused for xyz")
+	}
+
+	w := forwarded("abc")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	transfer, _ := app.Transfers.GetTransfer(context.Background(), "abc")
+	if len(transfer.Downloads) != 1 || transfer.Downloads[0].Username != "bob" {
+		t.Errorf("expected one download by bob, got %v", transfer.Downloads)
+	}
+}
+
+func TestTransferFilesServesRanges(t *testing.T) {
+	tests := []struct {
+		name         string
+		header       http.Header
+		status       int
+		body         string
+		contentRange string
+		completed    bool
+	}{
+		{
+			name:      "full",
+			status:    http.StatusOK,
+			body:      "hello",
+			completed: true,
+		},
+		{
+			name:         "partial",
+			header:       http.Header{"Range": {"bytes=0-1"}},
+			status:       http.StatusPartialContent,
+			body:         "he",
+			contentRange: "bytes 0-1/5",
+		},
+		{
+			name:         "resumed to the end",
+			header:       http.Header{"Range": {"bytes=2-"}, "If-Range": {`"` + helloChecksum + `"`}},
+			status:       http.StatusPartialContent,
+			body:         "llo",
+			contentRange: "bytes 2-4/5",
+			completed:    true,
+		},
+		{
+			// the id says nothing about the content, it no longer matches
+			name:      "stale if-range",
+			header:    http.Header{"Range": {"bytes=2-"}, "If-Range": {`"abc"`}},
+			status:    http.StatusOK,
+			body:      "hello",
+			completed: true,
+		},
+		{
+			name:         "unsatisfiable",
+			header:       http.Header{"Range": {"bytes=10-"}},
+			status:       http.StatusRequestedRangeNotSatisfiable,
+			contentRange: "bytes */5",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.Registry.SetStream("abc", nil, &tunnel.StreamDetails{
+				Expires:    time.Now().Add(time.Minute),
+				Visibility: tunnel.VisibilityPublic,
+			})
+			err := app.Registry.StoreSpool(context.Background(), "abc", strings.NewReader("hello"), 5, &tunnel.Spool{
+				Filename:    "hello.txt",
+				ContentType: "text/plain",
+				Checksum:    helloChecksum,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/download/direct/abc", nil)
+			r.SetPathValue("id", "abc")
+			maps.Copy(r.Header, test.header)
+			w := httptest.NewRecorder()
+			handleTransferFiles(app)(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("expected status %d, got %d", test.status, w.Code)
+			}
+			if test.status != http.StatusRequestedRangeNotSatisfiable && w.Body.String() != test.body {
+				t.Errorf("expected body %q, got %q", test.body, w.Body.String())
+			}
+			if contentRange := w.Header().Get("Content-Range"); contentRange != test.contentRange {
+				t.Errorf("expected Content-Range %q, got %q", test.contentRange, contentRange)
+			}
+
+			// only a download that reached the end of the file retires it
+			if _, ok := app.Registry.GetStreamDetails("abc"); ok == test.completed {
+				t.Errorf("expected the download to be completed: %v", test.completed)
+			}
+		})
+	}
+}
+
+func TestTransferFilesWaitsForSender(t *testing.T) {
+	app := newTestApp(t)
+
+	channel := make(chan tunnel.Stream)
+	app.Registry.SetStream("abc", channel, &tunnel.StreamDetails{
+		Expires:    time.Now().Add(time.Minute),
+		Visibility: tunnel.VisibilityPublic,
+	})
+
+	go serveFromSender(app, "abc")
+
+	w := transferRequest(app, "abc")
+	if body, _ := io.ReadAll(w.Body); string(body) != "hello" {
+		t.Errorf("expected body hello, got %q", body)
+	}
+}
+
+func TestTransferFilesOutlastsWriteTimeout(t *testing.T) {
+	app := newTestApp(t)
+
+	channel := make(chan tunnel.Stream)
+	app.Registry.SetStream("abc", channel, &tunnel.StreamDetails{
+		Expires:    time.Now().Add(time.Minute),
+		Visibility: tunnel.VisibilityPublic,
+	})
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.SetPathValue("id", "abc")
+		handleTransferFiles(app)(w, r)
+	}))
+	server.Config.WriteTimeout = 50 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	// the sender answers after the write timeout of the server
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		serveFromSender(app, "abc")
+	}()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if body, err := io.ReadAll(response.Body); err != nil || string(body) != "hello" {
+		t.Errorf("expected body hello, got %q, %v", body, err)
+	}
+}
+
+func TestTransferFilesRelaysChecksumTrailer(t *testing.T) {
+	app := newTestApp(t)
+
+	channel := make(chan tunnel.Stream)
+	app.Registry.SetStream("abc", channel, &tunnel.StreamDetails{
+		Expires:    time.Now().Add(time.Minute),
+		Visibility: tunnel.VisibilityPublic,
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.SetPathValue("id", "abc")
+		handleTransferFiles(app)(w, r)
+	}))
+	defer server.Close()
+
+	go func() {
+		stream, err := app.Registry.WaitRecipient(context.Background(), "abc")
+		if err != nil {
+			return
+		}
+		spool := &tunnel.Spool{Filename: "hello.txt", ContentType: "text/plain"}
+		io.WriteString(stream.Relay(spool), "hello")
+		// only known once everything was relayed
+		spool.Checksum = helloChecksum
+		close(stream.Done)
+	}()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if body, _ := io.ReadAll(response.Body); string(body) != "hello" {
+		t.Errorf("expected body hello, got %q", body)
+	}
+	if digest := response.Trailer.Get("Digest"); digest != "sha-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=" {
+		t.Errorf("expected the sha-256 digest of hello as a trailer, got %q", digest)
+	}
+}
+
+// serveFromSender answers the next recipient of the transfer with hello.
+func serveFromSender(app App, id string) {
+	stream, err := app.Registry.WaitRecipient(context.Background(), id)
+	if err != nil {
+		return
+	}
+	writer := stream.Relay(&tunnel.Spool{Filename: "hello.txt", ContentType: "text/plain"})
+	io.WriteString(writer, "hello")
+	close(stream.Done)
+}
+
+func TestTransferFilesKeepsSenderOnAbort(t *testing.T) {
+	app := newTestApp(t)
+
+	channel := make(chan tunnel.Stream)
+	app.Registry.SetStream("abc", channel, &tunnel.StreamDetails{
+		Expires:    time.Now().Add(time.Minute),
+		Visibility: tunnel.VisibilityPublic,
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/download/direct/abc?format=bogus", nil)
+	r.SetPathValue("id", "abc")
+	w := httptest.NewRecorder()
+	handleTransferFiles(app)(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an unknown format, got %d", w.Code)
+	}
+
+	// a recipient that is gone before the sender picks its request up
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r = httptest.NewRequest(http.MethodGet, "/download/direct/abc", nil).WithContext(ctx)
+	r.SetPathValue("id", "abc")
+	handleTransferFiles(app)(httptest.NewRecorder(), r)
+
+	go serveFromSender(app, "abc")
+
+	w = transferRequest(app, "abc")
+	if body, _ := io.ReadAll(w.Body); string(body) != "hello" {
+		t.Errorf("expected the next recipient to get hello, got %q", body)
+	}
+}
+
+func TestTransferFilesNotFound(t *testing.T) {
+	app := newTestApp(t)
+
+	w := transferRequest(app, "missing")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+}
+
+func unlockRequest(app App, id, password, address string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/download/"+id+"/unlock", strings.NewReader(url.Values{"password": {password}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = address + ":1234"
+	r.SetPathValue("id", id)
+	w := httptest.NewRecorder()
+	handleUnlockDownload(app)(w, r)
+
+	return w
+}
+
+func TestUnlockDownloadLimitsAttempts(t *testing.T) {
+	app := newTestApp(t)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Registry.SetStream("abc", nil, &tunnel.StreamDetails{
+		Expires:      time.Now().Add(time.Minute),
+		Visibility:   tunnel.VisibilityPassword,
+		PasswordHash: hash,
+	})
+
+	// concurrent guesses from one address are counted before the slow
+	// password check, so only 5 of them get checked
+	var checked atomic.Int32
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := unlockRequest(app, "abc", "wrong", "10.0.0.1"); strings.Contains(w.Body.String(), "Invalid password") {
+				checked.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if checked.Load() != 5 {
+		t.Errorf("expected 5 checked guesses out of 10 concurrent ones, got %d", checked.Load())
+	}
+
+	if w := unlockRequest(app, "abc", "secret", "10.0.0.2"); w.Header().Get("HX-Redirect") != "/download/abc" {
+		t.Fatal("expected another address to unlock the transfer")
+	}
+	for range 5 {
+		unlockRequest(app, "abc", "wrong", "10.0.0.2")
+	}
+	if w := unlockRequest(app, "abc", "secret", "10.0.0.2"); !strings.Contains(w.Body.String(), "Too many attempts") {
+		t.Error("expected the address to be out of attempts")
+	}
+
+	// other addresses share the attempts of the transfer
+	for i := range 10 {
+		unlockRequest(app, "abc", "wrong", fmt.Sprintf("10.0.1.%d", i))
+	}
+	if w := unlockRequest(app, "abc", "secret", "10.0.2.1"); !strings.Contains(w.Body.String(), "Too many attempts") {
+		t.Error("expected the transfer to be out of attempts")
+	}
+}
+
+func revokeRequest(app App, id string, user *types.Session) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodDelete, "/transfers/"+id, nil)
+	r.SetPathValue("id", id)
+	r = r.WithContext(context.WithValue(r.Context(), SESSION_COOKIE, user))
+	w := httptest.NewRecorder()
+	handleRevokeTransfer(app)(w, r)
+
+	return w
+}
+
+func TestRevokeTransfer(t *testing.T) {
+	app := newTestApp(t)
+	ctx := context.Background()
+
+	channel := make(chan tunnel.Stream)
+	app.Registry.SetStream("abc", channel, &tunnel.StreamDetails{
+		UserID:  "owner",
+		Expires: time.Now().Add(time.Minute),
+	})
+	app.Transfers.CreateTransfer(ctx, types.Transfer{ID: "abc", UserID: "owner"})
+
+	if w := revokeRequest(app, "abc", &types.Session{ID: "other"}); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for another user, got %d", w.Code)
+	}
+
+	waiting := make(chan error, 1)
+	go func() {
+		_, err := app.Registry.WaitRecipient(ctx, "abc")
+		waiting <- err
+	}()
+
+	if w := revokeRequest(app, "abc", &types.Session{ID: "owner"}); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if err := <-waiting; !errors.Is(err, tunnel.ErrExpired) {
+		t.Errorf("expected waiting sender to be released, got %v", err)
+	}
+	if _, ok := app.Registry.GetStreamDetails("abc"); ok {
+		t.Error("expected revoked transfer to be deleted")
+	}
+	if transfer, _ := app.Transfers.GetTransfer(ctx, "abc"); !transfer.Revoked {
+		t.Error("expected transfer to be marked as revoked")
+	}
+}
+
+func declineRequest(app App, id string, user *types.Session) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodDelete, "/inbox/"+id, nil)
+	r.SetPathValue("id", id)
+	r = r.WithContext(context.WithValue(r.Context(), SESSION_COOKIE, user))
+	w := httptest.NewRecorder()
+	handleDeclineTransfer(app)(w, r)
+
+	return w
+}
+
+func TestDeclineTransfer(t *testing.T) {
+	app := newTestApp(t)
+	ctx := context.Background()
+	bob := &types.Session{ID: "bob", Username: "bob", Email: "bob@mail.com"}
+	carol := &types.Session{ID: "carol", Username: "carol"}
+
+	app.Registry.SetStream("shared", nil, &tunnel.StreamDetails{
+		Expires:    time.Now().Add(time.Minute),
+		Recipients: []string{"bob", "carol"},
+	})
+	app.Registry.SetStream("single", nil, &tunnel.StreamDetails{
+		Expires:    time.Now().Add(time.Minute),
+		Recipients: []string{"bob@mail.com"},
+	})
+	app.Transfers.CreateTransfer(ctx, types.Transfer{ID: "single"})
+	for _, id := range []string{"shared", "single"} {
+		app.Transfers.AddToInbox(ctx, bob.ID, id, time.Now().Add(time.Minute))
+	}
+	app.Transfers.AddToInbox(ctx, carol.ID, "shared", time.Now().Add(time.Minute))
+
+	for _, id := range []string{"shared", "single"} {
+		if w := declineRequest(app, id, bob); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+	}
+
+	if inbox, _ := app.Transfers.GetInbox(ctx, bob.ID); len(inbox) != 0 {
+		t.Errorf("expected an empty inbox, got %v", inbox)
+	}
+	// carol can still receive the shared transfer
+	if _, ok := app.Registry.GetStreamDetails("shared"); !ok {
+		t.Error("expected the shared transfer to stay active")
+	}
+	if _, ok := app.Registry.GetStreamDetails("single"); ok {
+		t.Error("expected the declined transfer to be revoked")
+	}
+	if transfer, _ := app.Transfers.GetTransfer(ctx, "single"); !transfer.Revoked {
+		t.Error("expected the declined transfer to be marked as revoked")
+	}
+}
+
+func TestTransferFilesAllowsMaxDownloads(t *testing.T) {
+	app := newTestApp(t)
+
+	app.Registry.SetStream("abc", nil, &tunnel.StreamDetails{
+		Expires:      time.Now().Add(time.Minute),
+		Visibility:   tunnel.VisibilityPublic,
+		MaxDownloads: 3,
+	})
+	app.Transfers.CreateTransfer(context.Background(), types.Transfer{ID: "abc"})
+	err := app.Registry.StoreSpool(context.Background(), "abc", strings.NewReader("hello"), 5, &tunnel.Spool{Filename: "hello.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 3 {
+		w := transferRequest(app, "abc")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected download %d to succeed, got %d", i+1, w.Code)
+		}
+		if body, _ := io.ReadAll(w.Body); string(body) != "hello" {
+			t.Errorf("expected body hello, got %q", body)
+		}
+	}
+
+	// every recipient got the file, the link is used up
+	if w := transferRequest(app, "abc"); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 after the last download, got %d", w.Code)
+	}
+	transfer, _ := app.Transfers.GetTransfer(context.Background(), "abc")
+	if len(transfer.Downloads) != 3 {
+		t.Errorf("expected 3 downloads in the history, got %v", transfer.Downloads)
+	}
+}
+
+// sessionRequest is a transferRequest made by a logged in user.
+func sessionRequest(t *testing.T, app App, id string, user *types.Session) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/download/direct/"+id, nil)
+	r.SetPathValue("id", id)
+	if user != nil {
+		session, err := util.CreateAccessToken(*user, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.AddCookie(&http.Cookie{Name: SESSION_COOKIE, Value: session})
+	}
+	w := httptest.NewRecorder()
+	handleTransferFiles(app)(w, r)
+
+	return w
+}
+
+func TestTransferFilesNamedRecipients(t *testing.T) {
+	secret := config.JWT_SECRET
+	t.Cleanup(func() { config.JWT_SECRET = secret })
+	config.JWT_SECRET = "test"
+
+	app := newTestApp(t)
+	app.Registry.SetStream("abc", nil, &tunnel.StreamDetails{
+		Expires:      time.Now().Add(time.Minute),
+		Visibility:   tunnel.VisibilityPrivate,
+		Recipients:   []string{"bob", "carol@example.com"},
+		MaxDownloads: 5,
+	})
+	app.Transfers.CreateTransfer(context.Background(), types.Transfer{ID: "abc"})
+	err := app.Registry.StoreSpool(context.Background(), "abc", strings.NewReader("hello"), 5, &tunnel.Spool{Filename: "hello.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		user   *types.Session
+		status int
+	}{
+		{"visitor", nil, http.StatusSeeOther},
+		{"someone else", &types.Session{ID: "3", Username: "eve", Email: "eve@example.com"}, http.StatusForbidden},
+		{"by username", &types.Session{ID: "1", Username: "bob", Email: "bob@example.com"}, http.StatusOK},
+		{"by email", &types.Session{ID: "2", Username: "carol", Email: "carol@example.com"}, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := sessionRequest(t, app, "abc", test.user)
+			if w.Code != test.status {
+				t.Errorf("expected status %d, got %d", test.status, w.Code)
+			}
+			if test.user == nil && w.Header().Get("Location") != "/login" {
+				t.Errorf("expected a redirect to /login, got %q", w.Header().Get("Location"))
+			}
+		})
+	}
+
+	transfer, _ := app.Transfers.GetTransfer(context.Background(), "abc")
+	var usernames []string
+	for _, download := range transfer.Downloads {
+		usernames = append(usernames, download.Username)
+	}
+	if !slices.Equal(usernames, []string{"bob", "carol"}) {
+		t.Errorf("expected downloads by bob and carol, got %v", usernames)
+	}
+}
+
+// readEvent reads the next Server-Sent Event, its name and its data joined
+// back into one string.
+func readEvent(t *testing.T, events *bufio.Reader) (string, string) {
+	t.Helper()
+
+	var name string
+	var data []string
+	for {
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected an event, got %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return name, strings.Join(data, "\n")
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+func TestTransferEventsStreamsStatus(t *testing.T) {
+	app := newTestApp(t)
+	app.Registry.SetStream("abc", make(chan tunnel.Stream), &tunnel.StreamDetails{
+		Expires:    time.Now().Add(time.Minute),
+		Visibility: tunnel.VisibilityPublic,
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /download/events/{id}", handleTransferEvents(app))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/download/events/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if contentType := res.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %q", contentType)
+	}
+	events := bufio.NewReader(res.Body)
+
+	if name, data := readEvent(t, events); name != "status" || !strings.Contains(data, "waiting for the download") {
+		t.Errorf("expected the current status first, got %s %q", name, data)
+	}
+
+	app.Registry.SetStatus("abc", tunnel.StatusUploading)
+	app.Registry.SetUploaded("abc", 1024)
+	for {
+		name, data := readEvent(t, events)
+		if name != "status" {
+			t.Fatalf("expected status events while uploading, got %s", name)
+		}
+		if strings.Contains(data, "Uploading 1") {
+			break
+		}
+	}
+
+	app.Registry.DeleteStream("abc")
+	name, data := readEvent(t, events)
+	if name != "expired" || !strings.Contains(data, "no longer available") {
+		t.Errorf("expected the expired event, got %s %q", name, data)
+	}
+	if _, err := events.ReadByte(); err != io.EOF {
+		t.Errorf("expected the stream to end after the expiry, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+// Command seal encrypts files on the sender's machine for end-to-end
+// encrypted transfers, the server only ever sees the sealed stream:
+//
+//	seal < report.pdf | ssh trisend --sealed report.pdf
+//
+// The key is printed on stderr and has to be appended to the link, browsers
+// keep the fragment to themselves and decrypt the download with it. Recipients
+// in a terminal open it again with seal -d:
+//
+//	ssh trisend get <id> | seal -d -key <key> > report.pdf
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"trisend/internal/seal"
+)
+
+func main() {
+	decrypt := flag.Bool("d", false, "decrypt stdin with -key")
+	encodedKey := flag.String("key", "", "key to decrypt with, a new one is generated to encrypt")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: seal < <file> | ssh trisend --sealed <filename>")
+		fmt.Fprintln(os.Stderr, "       seal -d -key <key> < <sealed file> > <file>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	stdout := bufio.NewWriter(os.Stdout)
+	var err error
+	if *decrypt {
+		err = open(stdout, os.Stdin, *encodedKey)
+	} else {
+		err = encrypt(stdout, os.Stdin, *encodedKey)
+	}
+	if err == nil {
+		err = stdout.Flush()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "seal: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func encrypt(w io.Writer, r io.Reader, encodedKey string) error {
+	key, err := seal.NewKey()
+	if encodedKey != "" {
+		key, err = seal.ParseKey(encodedKey)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the key is printed first, the link follows once the upload started
+	fmt.Fprintf(os.Stderr, "KEY: append #%s to the link\n", seal.EncodeKey(key))
+
+	sealed, err := seal.NewWriter(w, key)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(sealed, r); err != nil {
+		return err
+	}
+
+	return sealed.Close()
+}
+
+func open(w io.Writer, r io.Reader, encodedKey string) error {
+	// keys copied from a link may keep their #
+	if len(encodedKey) > 0 && encodedKey[0] == '#' {
+		encodedKey = encodedKey[1:]
+	}
+	key, err := seal.ParseKey(encodedKey)
+	if err != nil {
+		return err
+	}
+
+	opened, err := seal.NewReader(r, key)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, opened)
+	return err
+}
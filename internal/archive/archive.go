@@ -0,0 +1,147 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// Format is the kind of archive several files are bundled in.
+type Format string
+
+const (
+	Zip    Format = "zip"
+	Tar    Format = "tar"
+	TarGz  Format = "tar.gz"
+	TarZst Format = "tar.zst"
+)
+
+var Formats = []Format{Zip, Tar, TarGz, TarZst}
+
+// ParseFormat returns the format named by s, the usual short names of
+// compressed tarballs are accepted too.
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(strings.TrimPrefix(s, ".")) {
+	case "zip":
+		return Zip, nil
+	case "tar":
+		return Tar, nil
+	case "tar.gz", "tgz":
+		return TarGz, nil
+	case "tar.zst", "tzst":
+		return TarZst, nil
+	}
+
+	return "", fmt.Errorf("unknown archive format %q, use one of zip, tar, tar.gz or tar.zst", s)
+}
+
+// Ext returns the file extension of the format, including the dot.
+func (f Format) Ext() string {
+	return "." + string(f)
+}
+
+func (f Format) ContentType() string {
+	switch f {
+	case Zip:
+		return "application/zip"
+	case TarGz:
+		return "application/gzip"
+	case TarZst:
+		return "application/zstd"
+	}
+
+	return "application/x-tar"
+}
+
+// Header describes an entry of an archive. Mode carries the type bits, so
+// directories and symlinks are told apart from regular files.
+type Header struct {
+	Name     string
+	Mode     fs.FileMode
+	ModTime  time.Time
+	Size     int64
+	Linkname string
+}
+
+type Writer interface {
+	// WriteEntry adds an entry to the archive, the content of regular files
+	// is read from r and must be exactly Size bytes long.
+	WriteEntry(h *Header, r io.Reader) error
+	Close() error
+}
+
+type Reader interface {
+	// Next returns the next entry and a reader for its content, io.EOF is
+	// returned after the last entry.
+	Next() (*Header, io.Reader, error)
+	Close() error
+}
+
+// NewWriter returns a writer that streams an archive of the given format to w.
+func NewWriter(w io.Writer, format Format) (Writer, error) {
+	switch format {
+	case Zip:
+		return newZipWriter(w), nil
+	case Tar, TarGz, TarZst:
+		return newTarWriter(w, format)
+	}
+
+	return nil, fmt.Errorf("unknown archive format %q", format)
+}
+
+// NewReader reads an archive of the given format. Zip archives keep their
+// index at the end, so r has to be seekable and size has to be known.
+func NewReader(r io.ReadSeeker, size int64, format Format) (Reader, error) {
+	switch format {
+	case Zip:
+		return newZipReader(r, size)
+	case Tar, TarGz, TarZst:
+		return newTarReader(r, format)
+	}
+
+	return nil, fmt.Errorf("unknown archive format %q", format)
+}
+
+// SingleFile returns a reader with r as its only entry, so a file sent as
+// is can be converted into an archive.
+func SingleFile(h *Header, r io.Reader) Reader {
+	return &singleFileReader{header: h, r: r}
+}
+
+type singleFileReader struct {
+	header *Header
+	r      io.Reader
+	done   bool
+}
+
+func (s *singleFileReader) Next() (*Header, io.Reader, error) {
+	if s.done {
+		return nil, nil, io.EOF
+	}
+	s.done = true
+
+	return s.header, s.r, nil
+}
+
+func (s *singleFileReader) Close() error {
+	return nil
+}
+
+// Copy writes every entry of src to dst, converting between formats.
+func Copy(dst Writer, src Reader) error {
+	for {
+		header, content, err := src.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := dst.WriteEntry(header, content); err != nil {
+			return err
+		}
+	}
+}
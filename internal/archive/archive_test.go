@@ -0,0 +1,119 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeSample(t *testing.T, format Format) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	writer, err := NewWriter(buf, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	entries := []struct {
+		header  *Header
+		content string
+	}{
+		{&Header{Name: "src", Mode: fs.ModeDir | 0o755, ModTime: modTime}, ""},
+		{&Header{Name: "src/run.sh", Mode: 0o755, ModTime: modTime, Size: 11}, "echo hello\n"},
+		{&Header{Name: "src/latest", Mode: fs.ModeSymlink | 0o777, ModTime: modTime, Linkname: "run.sh"}, ""},
+	}
+	for _, entry := range entries {
+		if err := writer.WriteEntry(entry.header, strings.NewReader(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func checkSample(t *testing.T, data []byte, format Format) {
+	t.Helper()
+
+	reader, err := NewReader(bytes.NewReader(data), int64(len(data)), format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	headers := map[string]*Header{}
+	contents := map[string]string{}
+	for {
+		header, content, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := io.ReadAll(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := strings.TrimSuffix(header.Name, "/")
+		headers[name] = header
+		contents[name] = string(body)
+	}
+
+	if h := headers["src"]; h == nil || !h.Mode.IsDir() {
+		t.Errorf("%s: expected src to be a directory, got %+v", format, h)
+	}
+	if h := headers["src/run.sh"]; h == nil || h.Mode.Perm() != 0o755 || contents["src/run.sh"] != "echo hello\n" {
+		t.Errorf("%s: expected executable run.sh, got %+v %q", format, h, contents["src/run.sh"])
+	}
+	if h := headers["src/latest"]; h == nil || h.Mode&fs.ModeSymlink == 0 || h.Linkname != "run.sh" {
+		t.Errorf("%s: expected symlink to run.sh, got %+v", format, h)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range Formats {
+		checkSample(t, writeSample(t, format), format)
+	}
+}
+
+func TestCopyBetweenFormats(t *testing.T) {
+	data := writeSample(t, Zip)
+
+	for _, format := range Formats {
+		src, err := NewReader(bytes.NewReader(data), int64(len(data)), Zip)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := &bytes.Buffer{}
+		dst, err := NewWriter(buf, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Copy(dst, src); err != nil {
+			t.Fatal(err)
+		}
+		if err := dst.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		checkSample(t, buf.Bytes(), format)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	if format, err := ParseFormat("tgz"); err != nil || format != TarGz {
+		t.Errorf("expected tgz to parse as tar.gz, got %q %v", format, err)
+	}
+	if _, err := ParseFormat("rar"); err == nil {
+		t.Errorf("expected rar to be rejected")
+	}
+}
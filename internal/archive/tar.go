@@ -0,0 +1,142 @@
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type tarWriter struct {
+	tw         *tar.Writer
+	compressor io.WriteCloser
+}
+
+func newTarWriter(w io.Writer, format Format) (*tarWriter, error) {
+	writer := &tarWriter{}
+
+	switch format {
+	case TarGz:
+		writer.compressor = gzip.NewWriter(w)
+	case TarZst:
+		encoder, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		writer.compressor = encoder
+	}
+
+	if writer.compressor != nil {
+		w = writer.compressor
+	}
+	writer.tw = tar.NewWriter(w)
+
+	return writer, nil
+}
+
+func (w *tarWriter) WriteEntry(h *Header, r io.Reader) error {
+	header := &tar.Header{
+		Name:    h.Name,
+		Mode:    int64(h.Mode.Perm()),
+		ModTime: h.ModTime,
+		Format:  tar.FormatPAX,
+	}
+
+	switch {
+	case h.Mode.IsDir():
+		header.Typeflag = tar.TypeDir
+		header.Name = strings.TrimSuffix(header.Name, "/") + "/"
+	case h.Mode&fs.ModeSymlink != 0:
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = h.Linkname
+	default:
+		header.Typeflag = tar.TypeReg
+		header.Size = h.Size
+	}
+
+	if err := w.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	_, err := io.Copy(w.tw, r)
+	return err
+}
+
+func (w *tarWriter) Close() error {
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	if w.compressor != nil {
+		return w.compressor.Close()
+	}
+
+	return nil
+}
+
+type tarReader struct {
+	tr           *tar.Reader
+	decompressor io.Closer
+}
+
+func newTarReader(r io.Reader, format Format) (*tarReader, error) {
+	reader := &tarReader{}
+
+	switch format {
+	case TarGz:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		reader.decompressor = gz
+		r = gz
+	case TarZst:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		reader.decompressor = decoder.IOReadCloser()
+		r = decoder
+	}
+	reader.tr = tar.NewReader(r)
+
+	return reader, nil
+}
+
+func (r *tarReader) Next() (*Header, io.Reader, error) {
+	for {
+		header, err := r.tr.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeDir, tar.TypeSymlink:
+		default:
+			// hard links, devices and fifos have no counterpart in zip
+			continue
+		}
+
+		info := header.FileInfo()
+		return &Header{
+			Name:     header.Name,
+			Mode:     info.Mode(),
+			ModTime:  header.ModTime,
+			Size:     info.Size(),
+			Linkname: header.Linkname,
+		}, r.tr, nil
+	}
+}
+
+func (r *tarReader) Close() error {
+	if r.decompressor != nil {
+		return r.decompressor.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package archive
+
+import (
+	"archive/zip"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+)
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func newZipWriter(w io.Writer) *zipWriter {
+	return &zipWriter{zw: zip.NewWriter(w)}
+}
+
+func (w *zipWriter) WriteEntry(h *Header, r io.Reader) error {
+	fh := &zip.FileHeader{
+		Name:     h.Name,
+		Method:   zip.Deflate,
+		Modified: h.ModTime,
+	}
+	fh.SetMode(h.Mode)
+
+	if h.Mode.IsDir() {
+		fh.Name = strings.TrimSuffix(fh.Name, "/") + "/"
+		fh.Method = zip.Store
+	}
+
+	entry, err := w.zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case h.Mode.IsDir():
+		return nil
+	case h.Mode&fs.ModeSymlink != 0:
+		// zip keeps the target of a symlink as its content
+		_, err = io.WriteString(entry, h.Linkname)
+	default:
+		_, err = io.Copy(entry, r)
+	}
+
+	return err
+}
+
+func (w *zipWriter) Close() error {
+	return w.zw.Close()
+}
+
+type zipReader struct {
+	files []*zip.File
+	next  int
+	open  io.ReadCloser
+}
+
+func newZipReader(r io.ReadSeeker, size int64) (*zipReader, error) {
+	zr, err := zip.NewReader(&seekReaderAt{r: r}, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &zipReader{files: zr.File}, nil
+}
+
+func (r *zipReader) Next() (*Header, io.Reader, error) {
+	if r.open != nil {
+		r.open.Close()
+		r.open = nil
+	}
+	if r.next == len(r.files) {
+		return nil, nil, io.EOF
+	}
+
+	file := r.files[r.next]
+	r.next++
+
+	header := &Header{
+		Name:    file.Name,
+		Mode:    file.Mode(),
+		ModTime: file.Modified,
+		Size:    int64(file.UncompressedSize64),
+	}
+	if header.Mode.IsDir() {
+		header.Size = 0
+		return header, eofReader{}, nil
+	}
+
+	content, err := file.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if header.Mode&fs.ModeSymlink != 0 {
+		defer content.Close()
+
+		target, err := io.ReadAll(content)
+		if err != nil {
+			return nil, nil, err
+		}
+		header.Linkname = string(target)
+		header.Size = 0
+
+		return header, eofReader{}, nil
+	}
+
+	r.open = content
+
+	return header, content, nil
+}
+
+func (r *zipReader) Close() error {
+	if r.open != nil {
+		return r.open.Close()
+	}
+
+	return nil
+}
+
+// seekReaderAt reads at an offset by seeking first. The zip reader only
+// reads one entry at a time, the mutex keeps it safe regardless.
+type seekReaderAt struct {
+	mutex sync.Mutex
+	r     io.ReadSeeker
+}
+
+func (s *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := s.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(s.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
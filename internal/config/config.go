@@ -3,7 +3,11 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var (
@@ -26,6 +30,42 @@ var (
 
 	CLIENT_ID     string
 	CLIENT_SECRET string
+
+	STORAGE_DRIVER string
+	STORAGE_DIR    string
+	STORE_FORWARD  bool
+	// SFTP_RELAY writes SFTP uploads straight into the response of the
+	// recipient instead of spooling them first, it has no effect together
+	// with STORE_FORWARD.
+	SFTP_RELAY bool
+	// NODE_URL is the address other instances reach this one with, setting
+	// it shares the links between instances through Redis.
+	NODE_URL string
+	// NODES are the addresses of the other instances, downloads are only
+	// forwarded to the instances listed.
+	NODES []string
+	// TRUST_PROXY takes the address of clients from X-Forwarded-For, only
+	// set it when a reverse proxy in front of the server writes it.
+	TRUST_PROXY bool
+
+	S3_ENDPOINT   string
+	S3_BUCKET     string
+	S3_REGION     string
+	S3_ACCESS_KEY string
+	S3_SECRET_KEY string
+)
+
+var (
+	// DEFAULT_EXPIRY is the lifetime of a link when the sender does not
+	// choose one, senders can not go over MAX_EXPIRY.
+	DEFAULT_EXPIRY = time.Minute * 10
+	MAX_EXPIRY     = time.Hour * 24
+	// JANITOR_INTERVAL is how often expired links, their spools and the temp
+	// files of crashed uploads are cleaned up.
+	JANITOR_INTERVAL = time.Minute
+	// SHUTDOWN_TIMEOUT is how long active transfers are given to finish
+	// when the server is asked to stop.
+	SHUTDOWN_TIMEOUT = time.Minute
 )
 
 func LoadConfig() {
@@ -59,6 +99,48 @@ func LoadConfig() {
 
 	CLIENT_ID = os.Getenv("CLIENT_ID")
 	CLIENT_SECRET = os.Getenv("CLIENT_SECRET")
+
+	STORAGE_DRIVER = os.Getenv("STORAGE_DRIVER")
+	STORAGE_DIR = os.Getenv("STORAGE_DIR")
+	STORE_FORWARD = os.Getenv("STORE_FORWARD") == "true"
+	SFTP_RELAY = os.Getenv("SFTP_RELAY") == "true"
+	NODE_URL = os.Getenv("NODE_URL")
+	NODES = nil
+	for _, node := range strings.Split(os.Getenv("NODES"), ",") {
+		if node = strings.TrimSuffix(strings.TrimSpace(node), "/"); node != "" {
+			NODES = append(NODES, node)
+		}
+	}
+	TRUST_PROXY = os.Getenv("TRUST_PROXY") == "true"
+
+	if STORAGE_DIR == "" {
+		STORAGE_DIR = filepath.Join(os.TempDir(), "trisend")
+	}
+
+	S3_ENDPOINT = os.Getenv("S3_ENDPOINT")
+	S3_BUCKET = os.Getenv("S3_BUCKET")
+	S3_REGION = os.Getenv("S3_REGION")
+	S3_ACCESS_KEY = os.Getenv("S3_ACCESS_KEY")
+	S3_SECRET_KEY = os.Getenv("S3_SECRET_KEY")
+
+	if expiry, err := time.ParseDuration(os.Getenv("DEFAULT_EXPIRY")); err == nil && expiry > 0 {
+		DEFAULT_EXPIRY = expiry
+	}
+	if expiry, err := time.ParseDuration(os.Getenv("MAX_EXPIRY")); err == nil && expiry > 0 {
+		MAX_EXPIRY = expiry
+	}
+	DEFAULT_EXPIRY = min(DEFAULT_EXPIRY, MAX_EXPIRY)
+	if interval, err := time.ParseDuration(os.Getenv("JANITOR_INTERVAL")); err == nil && interval > 0 {
+		JANITOR_INTERVAL = interval
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT")); err == nil && timeout >= 0 {
+		SHUTDOWN_TIMEOUT = timeout
+	}
+}
+
+// IsKnownNode reports whether node is one of the instances listed in NODES.
+func IsKnownNode(node string) bool {
+	return slices.Contains(NODES, strings.TrimSuffix(node, "/"))
 }
 
 func IsAppEnvProd() bool {
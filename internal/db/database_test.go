@@ -2,9 +2,10 @@ package db
 
 import (
 	"context"
+	"os"
 	"testing"
 	"time"
-	"trisend/config"
+	"trisend/internal/config"
 
 	"github.com/testcontainers/testcontainers-go/modules/redis"
 )
@@ -39,15 +40,32 @@ func NewRedisContainer() (Terminate, error) {
 	return container.Terminate, err
 }
 
+// skipWithoutDocker skips tests that need a container, testcontainers
+// panics when there is no Docker.
+func skipWithoutDocker(t *testing.T) {
+	if os.Getenv("DOCKER_HOST") != "" {
+		return
+	}
+	if _, err := os.Stat("/var/run/docker.sock"); err != nil {
+		t.Skip("docker is not available")
+	}
+}
+
 func TestConn(t *testing.T) {
-	terminateDB, err := NewRedisContainer()
-	defer terminateDB(context.Background())
+	skipWithoutDocker(t)
 
+	terminateDB, err := NewRedisContainer()
+	if terminateDB != nil {
+		defer terminateDB(context.Background())
+	}
 	if err != nil {
 		t.Fatalf("could not start redis container: %v", err)
 	}
 
-	redisDB := NewRedisDB()
+	redisDB, err := NewRedisDB()
+	if err != nil {
+		t.Fatalf("could not connect to redis: %v", err)
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
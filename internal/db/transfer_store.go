@@ -0,0 +1,217 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"trisend/internal/types"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TRANSFER_HISTORY is how long transfers are kept in the history of their
+// sender after they were created.
+const TRANSFER_HISTORY = time.Hour * 24 * 30
+
+type TransferStore interface {
+	CreateTransfer(ctx context.Context, transfer types.Transfer) error
+	SetTransferSize(ctx context.Context, id string, size int64) error
+	AddDownload(ctx context.Context, id string, download types.Download) error
+	RevokeTransfer(ctx context.Context, id string) error
+	// GetTransfer returns nil when the transfer is not in any history.
+	GetTransfer(ctx context.Context, id string) (*types.Transfer, error)
+	// GetTransfers returns the history of the user, newest first.
+	GetTransfers(ctx context.Context, userID string) ([]types.Transfer, error)
+
+	// AddToInbox delivers a transfer to a recipient until it expires.
+	AddToInbox(ctx context.Context, userID, id string, expires time.Time) error
+	RemoveFromInbox(ctx context.Context, userID, id string) error
+	// GetInbox returns the ids of the transfers delivered to the user that
+	// have not expired yet, the first to expire first.
+	GetInbox(ctx context.Context, userID string) ([]string, error)
+}
+
+type transferRedisStore struct {
+	db *redis.Client
+}
+
+func NewTransferRedisStore(db *redis.Client) TransferStore {
+	return &transferRedisStore{
+		db: db,
+	}
+}
+
+func transferKey(id string) string {
+	return fmt.Sprintf("transfer:%s", id)
+}
+
+func downloadsKey(id string) string {
+	return fmt.Sprintf("transfer:%s:downloads", id)
+}
+
+func userTransfersKey(userID string) string {
+	return fmt.Sprintf("user:%s:transfers", userID)
+}
+
+func inboxKey(userID string) string {
+	return fmt.Sprintf("user:%s:inbox", userID)
+}
+
+func (store *transferRedisStore) CreateTransfer(ctx context.Context, transfer types.Transfer) error {
+	key := transferKey(transfer.ID)
+	data := map[string]interface{}{
+		"user_id":  transfer.UserID,
+		"filename": transfer.Filename,
+		"size":     transfer.Size,
+		"created":  transfer.Created.Unix(),
+		"expires":  transfer.Expires.Unix(),
+	}
+
+	pipe := store.db.TxPipeline()
+	pipe.HSet(ctx, key, data)
+	pipe.Expire(ctx, key, TRANSFER_HISTORY)
+
+	// the history of the user only keeps what has not expired yet
+	history := userTransfersKey(transfer.UserID)
+	pipe.ZAdd(ctx, history, redis.Z{Score: float64(transfer.Created.Unix()), Member: transfer.ID})
+	pipe.ZRemRangeByScore(ctx, history, "-inf", strconv.FormatInt(time.Now().Add(-TRANSFER_HISTORY).Unix(), 10))
+	pipe.Expire(ctx, history, TRANSFER_HISTORY)
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (store *transferRedisStore) SetTransferSize(ctx context.Context, id string, size int64) error {
+	return store.db.HSet(ctx, transferKey(id), "size", size).Err()
+}
+
+func (store *transferRedisStore) AddDownload(ctx context.Context, id string, download types.Download) error {
+	key := downloadsKey(id)
+	data := fmt.Sprintf("%d/%s", download.At.Unix(), download.Username)
+
+	pipe := store.db.TxPipeline()
+	pipe.RPush(ctx, key, data)
+	pipe.Expire(ctx, key, TRANSFER_HISTORY)
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (store *transferRedisStore) RevokeTransfer(ctx context.Context, id string) error {
+	return store.db.HSet(ctx, transferKey(id), "revoked", "1").Err()
+}
+
+func (store *transferRedisStore) GetTransfer(ctx context.Context, id string) (*types.Transfer, error) {
+	pipe := store.db.Pipeline()
+	data := pipe.HGetAll(ctx, transferKey(id))
+	downloads := pipe.LRange(ctx, downloadsKey(id), 0, -1)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	if len(data.Val()) == 0 {
+		return nil, nil
+	}
+
+	transfer := parseTransfer(id, data.Val())
+	transfer.Downloads = parseDownloads(downloads.Val())
+
+	return transfer, nil
+}
+
+func (store *transferRedisStore) GetTransfers(ctx context.Context, userID string) ([]types.Transfer, error) {
+	ids, err := store.db.ZRevRange(ctx, userTransfersKey(userID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := store.db.Pipeline()
+	data := make([]*redis.MapStringStringCmd, len(ids))
+	downloads := make([]*redis.StringSliceCmd, len(ids))
+	for i, id := range ids {
+		data[i] = pipe.HGetAll(ctx, transferKey(id))
+		downloads[i] = pipe.LRange(ctx, downloadsKey(id), 0, -1)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	transfers := make([]types.Transfer, 0, len(ids))
+	for i, id := range ids {
+		if len(data[i].Val()) == 0 {
+			continue
+		}
+
+		transfer := parseTransfer(id, data[i].Val())
+		transfer.Downloads = parseDownloads(downloads[i].Val())
+		transfers = append(transfers, *transfer)
+	}
+
+	return transfers, nil
+}
+
+func (store *transferRedisStore) AddToInbox(ctx context.Context, userID, id string, expires time.Time) error {
+	key := inboxKey(userID)
+
+	pipe := store.db.TxPipeline()
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(expires.Unix()), Member: id})
+	// the inbox lives as long as its last transfer
+	pipe.ExpireNX(ctx, key, time.Until(expires))
+	pipe.ExpireGT(ctx, key, time.Until(expires))
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (store *transferRedisStore) RemoveFromInbox(ctx context.Context, userID, id string) error {
+	return store.db.ZRem(ctx, inboxKey(userID), id).Err()
+}
+
+func (store *transferRedisStore) GetInbox(ctx context.Context, userID string) ([]string, error) {
+	key := inboxKey(userID)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	pipe := store.db.TxPipeline()
+	pipe.ZRemRangeByScore(ctx, key, "-inf", now)
+	ids := pipe.ZRange(ctx, key, 0, -1)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	return ids.Val(), nil
+}
+
+func parseTransfer(id string, data map[string]string) *types.Transfer {
+	size, _ := strconv.ParseInt(data["size"], 10, 64)
+	created, _ := strconv.ParseInt(data["created"], 10, 64)
+	expires, _ := strconv.ParseInt(data["expires"], 10, 64)
+
+	return &types.Transfer{
+		ID:       id,
+		UserID:   data["user_id"],
+		Filename: data["filename"],
+		Size:     size,
+		Created:  time.Unix(created, 0),
+		Expires:  time.Unix(expires, 0),
+		Revoked:  data["revoked"] == "1",
+	}
+}
+
+func parseDownloads(data []string) []types.Download {
+	downloads := make([]types.Download, 0, len(data))
+	for _, value := range data {
+		at, username, _ := strings.Cut(value, "/")
+		unix, _ := strconv.ParseInt(at, 10, 64)
+
+		downloads = append(downloads, types.Download{
+			Username: username,
+			At:       time.Unix(unix, 0),
+		})
+	}
+
+	return downloads
+}
@@ -3,7 +3,9 @@ package db
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 	"trisend/internal/types"
 
 	"github.com/google/uuid"
@@ -15,12 +17,29 @@ type UserStore interface {
 	UpdateUser(context.Context, types.CreateUser) (*types.Session, error)
 	DeleteUser(context.Context, string) error
 	FindByEmail(context.Context, string) (*types.Session, error)
+	// FindByUsername returns nil when nobody has the username.
+	FindByUsername(ctx context.Context, username string) (*types.Session, error)
 	GetBySSHKey(context.Context, string) (*types.Session, error)
+	GetUser(ctx context.Context, userID string) (*types.Session, error)
 
 	AddSSHKey(ctx context.Context, userID, title, fingerprint string) error
 	DeleteSSHKey(ctx context.Context, sshID string) error
 	GetSSHKeys(ctx context.Context, userID string) ([]types.SSHKey, error)
 	SSHKeyExists(ctx context.Context, fingerprint string) (bool, error)
+
+	GetQuota(ctx context.Context, userID string) (*types.Quota, error)
+	GetDailyUsage(ctx context.Context, userID string) (int64, error)
+	// ReserveDailyUsage adds up to size bytes to the usage of the user on
+	// day, without going over limit when it is positive. It returns the
+	// bytes reserved and the usage before.
+	ReserveDailyUsage(ctx context.Context, userID string, day time.Time, size, limit int64) (reserved, used int64, err error)
+	// RefundDailyUsage takes back bytes reserved on day that were not used.
+	RefundDailyUsage(ctx context.Context, userID string, day time.Time, size int64) error
+	AcquireTransfer(ctx context.Context, userID string, limit int) (bool, error)
+	ReleaseTransfer(ctx context.Context, userID string) error
+
+	GetNotifications(ctx context.Context, userID string) (*types.Notifications, error)
+	SetNotifications(ctx context.Context, userID string, notifications types.Notifications) error
 }
 
 type redisStore struct {
@@ -46,6 +65,7 @@ func (store *redisStore) CreateUser(ctx context.Context, user types.CreateUser)
 
 	pipe.HSet(ctx, key, data).Err()
 	pipe.SAdd(ctx, fmt.Sprintf("email:%s", user.Email), userID)
+	pipe.SAdd(ctx, usernameKey(user.Username), userID)
 
 	_, err := pipe.Exec(ctx)
 	if err != nil {
@@ -62,9 +82,14 @@ func (store *redisStore) CreateUser(ctx context.Context, user types.CreateUser)
 	return createdUser, nil
 }
 
+// UpdateUser updates the user registered with the email of user, it
+// returns nil when there is none.
 func (store *redisStore) UpdateUser(ctx context.Context, user types.CreateUser) (*types.Session, error) {
-	userID := uuid.NewString()
-	key := fmt.Sprintf("user:%s", userID)
+	current, err := store.FindByEmail(ctx, user.Email)
+	if err != nil || current == nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("user:%s", current.ID)
 
 	data := map[string]interface{}{
 		"email":    user.Email,
@@ -72,19 +97,26 @@ func (store *redisStore) UpdateUser(ctx context.Context, user types.CreateUser)
 		"pfp":      user.Pfp,
 	}
 
-	err := store.db.HSet(ctx, key, data).Err()
-	if err != nil {
+	pipe := store.db.TxPipeline()
+	pipe.HSet(ctx, key, data)
+	// recipients given with --to find the user by the new username
+	if usernameKey(current.Username) != usernameKey(user.Username) {
+		pipe.SRem(ctx, usernameKey(current.Username), current.ID)
+		pipe.SAdd(ctx, usernameKey(user.Username), current.ID)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
 		return nil, err
 	}
 
-	createdUser := &types.Session{
-		ID:       userID,
+	updatedUser := &types.Session{
+		ID:       current.ID,
 		Email:    user.Email,
 		Username: user.Username,
 		Pfp:      user.Pfp,
 	}
 
-	return createdUser, nil
+	return updatedUser, nil
 }
 
 func (store *redisStore) DeleteUser(ctx context.Context, userID string) error {
@@ -127,6 +159,57 @@ func (store *redisStore) FindByEmail(ctx context.Context, email string) (*types.
 	return user, nil
 }
 
+func usernameKey(username string) string {
+	return fmt.Sprintf("username:%s", strings.ToLower(username))
+}
+
+const usernamesMigrated = "migrations:usernames"
+
+// MigrateUsernames adds the users created before the username index to it,
+// once for all instances. Running it twice does no harm.
+func MigrateUsernames(ctx context.Context, rdb *redis.Client) error {
+	migrated, err := rdb.Exists(ctx, usernamesMigrated).Result()
+	if err != nil || migrated > 0 {
+		return err
+	}
+
+	iter := rdb.ScanType(ctx, 0, "user:*", 100, "hash").Iterator()
+	for iter.Next(ctx) {
+		userID := strings.TrimPrefix(iter.Val(), "user:")
+		// the hashes of a user are keyed user:<id>, anything longer is not one
+		if strings.Contains(userID, ":") {
+			continue
+		}
+
+		username, err := rdb.HGet(ctx, iter.Val(), "username").Result()
+		if err == redis.Nil || username == "" {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err := rdb.SAdd(ctx, usernameKey(username), userID).Err(); err != nil {
+			return err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	return rdb.Set(ctx, usernamesMigrated, time.Now().Unix(), 0).Err()
+}
+
+func (store *redisStore) FindByUsername(ctx context.Context, username string) (*types.Session, error) {
+	userIDs, err := store.db.SMembers(ctx, usernameKey(username)).Result()
+	if err != nil {
+		return nil, err
+	} else if len(userIDs) == 0 {
+		return nil, nil
+	}
+
+	return store.GetUser(ctx, userIDs[0])
+}
+
 func (store *redisStore) GetBySSHKey(ctx context.Context, fingerprint string) (*types.Session, error) {
 	key := fmt.Sprintf("ssh_finger:%s:ssh_key", fingerprint)
 	data, err := store.db.SMembers(ctx, key).Result()
@@ -154,6 +237,27 @@ func (store *redisStore) GetBySSHKey(ctx context.Context, fingerprint string) (*
 	return user, nil
 }
 
+// GetUser returns nil when the user does not exist.
+func (store *redisStore) GetUser(ctx context.Context, userID string) (*types.Session, error) {
+	key := fmt.Sprintf("user:%s", userID)
+	userMap, err := store.db.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(userMap) == 0 {
+		return nil, nil
+	}
+
+	user := &types.Session{
+		ID:       userID,
+		Email:    userMap["email"],
+		Username: userMap["username"],
+		Pfp:      userMap["pfp"],
+	}
+
+	return user, nil
+}
+
 func (store *redisStore) AddSSHKey(ctx context.Context, userID, title, fingerprint string) error {
 	sshID := uuid.NewString()
 
@@ -264,3 +368,144 @@ func (store *redisStore) SSHKeyExists(ctx context.Context, fingerprint string) (
 
 	return true, nil
 }
+
+// GetQuota returns the quota of the user's plan, overridden by any limit
+// stored in the user hash.
+func (store *redisStore) GetQuota(ctx context.Context, userID string) (*types.Quota, error) {
+	key := fmt.Sprintf("user:%s", userID)
+
+	data, err := store.db.HMGet(ctx, key, "plan", "max_file_size", "daily_bytes", "concurrent_transfers").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	plan, _ := data[0].(string)
+	quota, ok := types.Plans[plan]
+	if !ok {
+		quota = types.Plans[types.DefaultPlan]
+	}
+
+	if value, ok := data[1].(string); ok {
+		quota.MaxFileSize, _ = strconv.ParseInt(value, 10, 64)
+	}
+	if value, ok := data[2].(string); ok {
+		quota.DailyBytes, _ = strconv.ParseInt(value, 10, 64)
+	}
+	if value, ok := data[3].(string); ok {
+		quota.ConcurrentTransfers, _ = strconv.Atoi(value)
+	}
+
+	return &quota, nil
+}
+
+func dailyUsageKey(userID string, day time.Time) string {
+	return fmt.Sprintf("user:%s:usage:%s", userID, day.UTC().Format("20060102"))
+}
+
+func (store *redisStore) GetDailyUsage(ctx context.Context, userID string) (int64, error) {
+	used, err := store.db.Get(ctx, dailyUsageKey(userID, time.Now())).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+
+	return used, err
+}
+
+// reserveDailyUsage checks what is left and reserves it in one step, so
+// concurrent uploads can not both spend the same bytes.
+var reserveDailyUsage = redis.NewScript(`
+local used = tonumber(redis.call("GET", KEYS[1]) or "0")
+local reserved = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+if limit > 0 then
+	reserved = math.min(reserved, math.max(limit - used, 0))
+end
+if reserved > 0 then
+	redis.call("INCRBY", KEYS[1], reserved)
+	redis.call("EXPIRE", KEYS[1], ARGV[3])
+end
+return {reserved, used}
+`)
+
+func (store *redisStore) ReserveDailyUsage(ctx context.Context, userID string, day time.Time, size, limit int64) (int64, int64, error) {
+	key := dailyUsageKey(userID, day)
+
+	result, err := reserveDailyUsage.Run(ctx, store.db, []string{key}, size, limit, int64((time.Hour * 25).Seconds())).Int64Slice()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return result[0], result[1], nil
+}
+
+func (store *redisStore) RefundDailyUsage(ctx context.Context, userID string, day time.Time, size int64) error {
+	return store.db.DecrBy(ctx, dailyUsageKey(userID, day), size).Err()
+}
+
+// AcquireTransfer reserves one of the user's concurrent transfers, it
+// returns false when limit transfers are already running.
+func (store *redisStore) AcquireTransfer(ctx context.Context, userID string, limit int) (bool, error) {
+	key := fmt.Sprintf("user:%s:active", userID)
+
+	pipe := store.db.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	// expire so counters leaked by a crash do not block the user forever
+	pipe.Expire(ctx, key, time.Hour*24)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+
+	active := incr.Val()
+	if limit > 0 && active > int64(limit) {
+		return false, store.db.Decr(ctx, key).Err()
+	}
+
+	return true, nil
+}
+
+func (store *redisStore) ReleaseTransfer(ctx context.Context, userID string) error {
+	key := fmt.Sprintf("user:%s:active", userID)
+	return store.db.Decr(ctx, key).Err()
+}
+
+// GetNotifications returns the emails the user opted in to, none by default.
+func (store *redisStore) GetNotifications(ctx context.Context, userID string) (*types.Notifications, error) {
+	key := fmt.Sprintf("user:%s", userID)
+
+	data, err := store.db.HMGet(ctx, key, "notify_first_download", "notify_every_download", "notify_expired", "notify_inbox").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	enabled := func(value interface{}) bool {
+		return value == "1"
+	}
+
+	return &types.Notifications{
+		FirstDownload: enabled(data[0]),
+		EveryDownload: enabled(data[1]),
+		Expired:       enabled(data[2]),
+		Inbox:         enabled(data[3]),
+	}, nil
+}
+
+func (store *redisStore) SetNotifications(ctx context.Context, userID string, notifications types.Notifications) error {
+	key := fmt.Sprintf("user:%s", userID)
+
+	flag := func(enabled bool) string {
+		if enabled {
+			return "1"
+		}
+		return "0"
+	}
+
+	data := map[string]interface{}{
+		"notify_first_download": flag(notifications.FirstDownload),
+		"notify_every_download": flag(notifications.EveryDownload),
+		"notify_expired":        flag(notifications.Expired),
+		"notify_inbox":          flag(notifications.Inbox),
+	}
+
+	return store.db.HSet(ctx, key, data).Err()
+}
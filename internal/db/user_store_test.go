@@ -0,0 +1,97 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"trisend/internal/types"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedis(t *testing.T) *redis.Client {
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	return rdb
+}
+
+func TestUpdateUserKeepsID(t *testing.T) {
+	store := NewUserRedisStore(newTestRedis(t))
+	ctx := context.Background()
+
+	created, err := store.CreateUser(ctx, types.CreateUser{Email: "bob@mail.com", Username: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := store.UpdateUser(ctx, types.CreateUser{Email: "bob@mail.com", Username: "robert", Pfp: "pfp.webp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ID != created.ID {
+		t.Errorf("expected the update to keep the id %s, got %s", created.ID, updated.ID)
+	}
+	if user, _ := store.FindByEmail(ctx, "bob@mail.com"); user == nil || user.ID != created.ID || user.Username != "robert" {
+		t.Errorf("expected the stored user to be updated, got %v", user)
+	}
+
+	if user, err := store.UpdateUser(ctx, types.CreateUser{Email: "nobody@mail.com"}); err != nil || user != nil {
+		t.Errorf("expected nothing to update for an unknown email, got %v %v", user, err)
+	}
+}
+
+func TestFindByUsernameAfterUpdate(t *testing.T) {
+	rdb := newTestRedis(t)
+	store := NewUserRedisStore(rdb)
+	ctx := context.Background()
+
+	created, err := store.CreateUser(ctx, types.CreateUser{Email: "bob@mail.com", Username: "Bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := store.FindByUsername(ctx, "bob"); user == nil || user.ID != created.ID {
+		t.Fatalf("expected to find bob regardless of case, got %v", user)
+	}
+
+	updated, err := store.UpdateUser(ctx, types.CreateUser{Email: "bob@mail.com", Username: "robert"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ID != created.ID {
+		t.Errorf("expected the update to keep the id %s, got %s", created.ID, updated.ID)
+	}
+	if user, _ := store.FindByUsername(ctx, "robert"); user == nil || user.ID != created.ID {
+		t.Errorf("expected to find the user by the new username, got %v", user)
+	}
+	if user, _ := store.FindByUsername(ctx, "bob"); user != nil {
+		t.Errorf("expected the old username to be free, got %v", user)
+	}
+}
+
+func TestMigrateUsernames(t *testing.T) {
+	rdb := newTestRedis(t)
+	store := NewUserRedisStore(rdb)
+	ctx := context.Background()
+
+	// a user created before the username index existed
+	rdb.HSet(ctx, "user:old", map[string]string{"email": "carol@mail.com", "username": "Carol"})
+	rdb.SAdd(ctx, "user:old:transfers", "abc")
+
+	if err := MigrateUsernames(ctx, rdb); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := store.FindByUsername(ctx, "carol"); user == nil || user.ID != "old" {
+		t.Errorf("expected the migrated user to be found, got %v", user)
+	}
+
+	// later users are indexed on creation, the migration does not run again
+	rdb.HSet(ctx, "user:late", map[string]string{"username": "dave"})
+	if err := MigrateUsernames(ctx, rdb); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := store.FindByUsername(ctx, "dave"); user != nil {
+		t.Errorf("expected the migration to run once, got %v", user)
+	}
+}
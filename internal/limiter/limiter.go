@@ -0,0 +1,117 @@
+// Package limiter bounds the attempts made against a key within a time
+// window, such as the password guesses on a link.
+package limiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter counts attempts per key. An attempt is reserved before it is
+// made, so concurrent attempts can not go over the limit together.
+type Limiter interface {
+	// Reserve counts an attempt for key, it returns false when key is out
+	// of attempts until its window is over.
+	Reserve(ctx context.Context, key string) (bool, error)
+	// Release gives back an attempt reserved for key.
+	Release(ctx context.Context, key string) error
+	// Reset forgets the attempts of key.
+	Reset(ctx context.Context, key string) error
+}
+
+// MemoryLimiter keeps the attempts in process memory, every instance has
+// its own budget.
+type MemoryLimiter struct {
+	mutex    sync.Mutex
+	max      int
+	window   time.Duration
+	attempts map[string]*attempts
+}
+
+type attempts struct {
+	count int
+	reset time.Time
+}
+
+func NewMemoryLimiter(max int, window time.Duration) *MemoryLimiter {
+	return &MemoryLimiter{
+		max:      max,
+		window:   window,
+		attempts: map[string]*attempts{},
+	}
+}
+
+func (l *MemoryLimiter) Reserve(ctx context.Context, key string) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	for k, value := range l.attempts {
+		if now.After(value.reset) {
+			delete(l.attempts, k)
+		}
+	}
+
+	value, ok := l.attempts[key]
+	if !ok {
+		value = &attempts{reset: now.Add(l.window)}
+		l.attempts[key] = value
+	}
+	if value.count >= l.max {
+		return false, nil
+	}
+	value.count++
+
+	return true, nil
+}
+
+func (l *MemoryLimiter) Release(ctx context.Context, key string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if value, ok := l.attempts[key]; ok && value.count > 0 {
+		value.count--
+	}
+	return nil
+}
+
+func (l *MemoryLimiter) Reset(ctx context.Context, key string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.attempts, key)
+	return nil
+}
+
+// Passwords guards the passwords of transfers. Every client gets a few
+// guesses per transfer, and every transfer a bounded amount of guesses
+// from all clients together, so more addresses do not buy more guesses.
+type Passwords struct {
+	clients   Limiter
+	transfers Limiter
+}
+
+func NewPasswords(clients, transfers Limiter) *Passwords {
+	return &Passwords{clients: clients, transfers: transfers}
+}
+
+// Reserve counts a guess of client on the transfer id before the password
+// is checked.
+func (p *Passwords) Reserve(ctx context.Context, id, client string) (bool, error) {
+	if ok, err := p.clients.Reserve(ctx, id+"/"+client); err != nil || !ok {
+		return false, err
+	}
+
+	return p.transfers.Reserve(ctx, id)
+}
+
+// Succeeded gives the client its guesses back, and the transfer the guess
+// that was right, so a link opened by many recipients is not locked.
+func (p *Passwords) Succeeded(ctx context.Context, id, client string) error {
+	if err := p.clients.Reset(ctx, id+"/"+client); err != nil {
+		return err
+	}
+
+	return p.transfers.Release(ctx, id)
+}
@@ -0,0 +1,101 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestLimiters(t *testing.T, max int, window time.Duration) map[string]func() Limiter {
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	prefixes := 0
+	return map[string]func() Limiter{
+		"memory": func() Limiter {
+			return NewMemoryLimiter(max, window)
+		},
+		"redis": func() Limiter {
+			prefixes++
+			return NewRedisLimiter(rdb, fmt.Sprintf("attempts:%d", prefixes), max, window)
+		},
+	}
+}
+
+func TestReserveConcurrently(t *testing.T) {
+	for name, newLimiter := range newTestLimiters(t, 5, time.Minute) {
+		limiter := newLimiter()
+
+		var allowed atomic.Int32
+		var wg sync.WaitGroup
+		for range 50 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if ok, err := limiter.Reserve(context.Background(), "abc"); err == nil && ok {
+					allowed.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if allowed.Load() != 5 {
+			t.Errorf("%s: expected 5 attempts out of 50 concurrent ones, got %d", name, allowed.Load())
+		}
+
+		limiter.Reset(context.Background(), "abc")
+		if ok, _ := limiter.Reserve(context.Background(), "abc"); !ok {
+			t.Errorf("%s: expected an attempt after a reset", name)
+		}
+	}
+}
+
+func TestPasswordsCapTransfer(t *testing.T) {
+	for name, newLimiter := range newTestLimiters(t, 3, time.Minute) {
+		passwords := NewPasswords(newLimiter(), newLimiter())
+		ctx := context.Background()
+
+		// every client has attempts left, the transfer does not
+		for i := range 3 {
+			if ok, _ := passwords.Reserve(ctx, "abc", fmt.Sprintf("client-%d", i)); !ok {
+				t.Fatalf("%s: expected attempt %d to be allowed", name, i)
+			}
+		}
+		if ok, _ := passwords.Reserve(ctx, "abc", "client-3"); ok {
+			t.Errorf("%s: expected the transfer to be out of attempts", name)
+		}
+		if ok, _ := passwords.Reserve(ctx, "other", "client-0"); !ok {
+			t.Errorf("%s: expected another transfer to have its own attempts", name)
+		}
+
+		// a right guess does not use up the attempts of the transfer
+		passwords.Succeeded(ctx, "other", "client-0")
+		for i := range 3 {
+			if ok, _ := passwords.Reserve(ctx, "other", fmt.Sprintf("client-%d", i)); !ok {
+				t.Errorf("%s: expected attempt %d after a success to be allowed", name, i)
+			}
+		}
+	}
+}
+
+func TestMemoryLimiterWindow(t *testing.T) {
+	limiter := NewMemoryLimiter(1, time.Millisecond)
+	ctx := context.Background()
+
+	limiter.Reserve(ctx, "abc")
+	if ok, _ := limiter.Reserve(ctx, "abc"); ok {
+		t.Fatal("expected the second attempt to be refused")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if ok, _ := limiter.Reserve(ctx, "abc"); !ok {
+		t.Error("expected the attempts to be forgotten after the window")
+	}
+}
@@ -0,0 +1,48 @@
+package limiter
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisLimiter keeps the attempts in Redis, so all instances share one
+// budget.
+type RedisLimiter struct {
+	rdb    *redis.Client
+	prefix string
+	max    int64
+	window time.Duration
+}
+
+// NewRedisLimiter returns a limiter storing the attempts under prefix.
+func NewRedisLimiter(rdb *redis.Client, prefix string, max int, window time.Duration) *RedisLimiter {
+	return &RedisLimiter{rdb: rdb, prefix: prefix, max: int64(max), window: window}
+}
+
+func (l *RedisLimiter) key(key string) string {
+	return l.prefix + ":" + key
+}
+
+func (l *RedisLimiter) Reserve(ctx context.Context, key string) (bool, error) {
+	pipe := l.rdb.TxPipeline()
+	count := pipe.Incr(ctx, l.key(key))
+	// the window starts with the first attempt
+	pipe.ExpireNX(ctx, l.key(key), l.window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+
+	return count.Val() <= l.max, nil
+}
+
+func (l *RedisLimiter) Release(ctx context.Context, key string) error {
+	// only decrement a counter that still exists, DECR would recreate an
+	// expired one without a window
+	return l.rdb.Eval(ctx, `if redis.call("GET", KEYS[1]) then return redis.call("DECR", KEYS[1]) end return 0`, []string{l.key(key)}).Err()
+}
+
+func (l *RedisLimiter) Reset(ctx context.Context, key string) error {
+	return l.rdb.Del(ctx, l.key(key)).Err()
+}
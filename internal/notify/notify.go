@@ -0,0 +1,168 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"sync"
+	"time"
+	"trisend/internal/config"
+	"trisend/internal/db"
+	"trisend/internal/mailer"
+	"trisend/internal/tunnel"
+	"trisend/internal/types"
+)
+
+// Notifier emails senders about their transfers once they disconnected,
+// according to the notifications they opted in to. A nil Notifier sends
+// nothing.
+type Notifier struct {
+	users     db.UserStore
+	transfers db.TransferStore
+	template  *template.Template
+	// send delivers an email, tests replace it
+	send func(subject, to, body string) error
+	wg   sync.WaitGroup
+}
+
+// NewNotifier renders the emails with the HTML template at templatePath.
+func NewNotifier(users db.UserStore, transfers db.TransferStore, templatePath string) (*Notifier, error) {
+	tmpl, err := template.ParseFiles(templatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Notifier{
+		users:     users,
+		transfers: transfers,
+		template:  tmpl,
+		send: func(subject, to, body string) error {
+			return mailer.NewMailer(subject, to, body).Send()
+		},
+	}, nil
+}
+
+// Downloaded tells the sender about the latest download of a transfer.
+func (n *Notifier) Downloaded(id string) {
+	if n == nil {
+		return
+	}
+
+	n.background(func(ctx context.Context) error {
+		transfer, err := n.transfers.GetTransfer(ctx, id)
+		if err != nil || transfer == nil || len(transfer.Downloads) == 0 {
+			return err
+		}
+
+		notifications, err := n.users.GetNotifications(ctx, transfer.UserID)
+		if err != nil {
+			return err
+		}
+		first := len(transfer.Downloads) == 1
+		if !notifications.EveryDownload && !(first && notifications.FirstDownload) {
+			return nil
+		}
+
+		recipient := transfer.Downloads[len(transfer.Downloads)-1].Username
+		if recipient == "" {
+			recipient = "A recipient"
+		}
+
+		return n.notify(ctx, transfer.UserID, types.TransferMail{
+			Title:    "Your file was downloaded",
+			Message:  fmt.Sprintf("%s downloaded your file, it was downloaded %d times so far.", recipient, len(transfer.Downloads)),
+			Filename: transfer.Filename,
+		})
+	})
+}
+
+// Expired tells the sender about a deleted transfer that expired without
+// being downloaded. It is meant to be registered with Registry.OnDelete.
+func (n *Notifier) Expired(details tunnel.StreamDetails) {
+	if n == nil || details.Downloads > 0 || time.Now().Before(details.Expires) {
+		return
+	}
+
+	n.background(func(ctx context.Context) error {
+		notifications, err := n.users.GetNotifications(ctx, details.UserID)
+		if err != nil || !notifications.Expired {
+			return err
+		}
+
+		return n.notify(ctx, details.UserID, types.TransferMail{
+			Title:    "Your link expired",
+			Message:  "Nobody downloaded your file before the link expired.",
+			Filename: details.Filename,
+		})
+	})
+}
+
+// Delivered tells a recipient about a transfer sent to its inbox.
+func (n *Notifier) Delivered(recipientID string, details tunnel.StreamDetails) {
+	if n == nil {
+		return
+	}
+
+	n.background(func(ctx context.Context) error {
+		notifications, err := n.users.GetNotifications(ctx, recipientID)
+		if err != nil || !notifications.Inbox {
+			return err
+		}
+
+		message := fmt.Sprintf("%s sent you a file, it can be downloaded until %s.", details.Username, details.Expires.Format("Jan 2 15:04 MST"))
+		if details.Message != "" {
+			message += " " + details.Message
+		}
+
+		return n.notify(ctx, recipientID, types.TransferMail{
+			Title:      "You received a file",
+			Message:    message,
+			Filename:   details.Filename,
+			Action:     "Open your inbox",
+			ActionLink: config.HOST + "/inbox",
+		})
+	})
+}
+
+// Wait blocks until the emails being sent are gone.
+func (n *Notifier) Wait() {
+	if n == nil {
+		return
+	}
+
+	n.wg.Wait()
+}
+
+// background runs notify without holding up the transfer.
+func (n *Notifier) background(notify func(ctx context.Context) error) {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		if err := notify(ctx); err != nil {
+			slog.Error(err.Error())
+		}
+	}()
+}
+
+func (n *Notifier) notify(ctx context.Context, userID string, mail types.TransferMail) error {
+	user, err := n.users.GetUser(ctx, userID)
+	if err != nil || user == nil || user.Email == "" {
+		return err
+	}
+
+	mail.Host = config.HOST
+	mail.Link = config.HOST + "/settings"
+
+	var body bytes.Buffer
+	if err := n.template.Execute(&body, mail); err != nil {
+		return err
+	}
+
+	return n.send(mail.Title, user.Email, body.String())
+}
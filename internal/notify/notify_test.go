@@ -0,0 +1,139 @@
+package notify
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"trisend/internal/db"
+	"trisend/internal/tunnel"
+	"trisend/internal/types"
+)
+
+// fakeUsers implements the parts of db.UserStore the notifier uses.
+type fakeUsers struct {
+	db.UserStore
+	notifications types.Notifications
+}
+
+func (f *fakeUsers) GetUser(ctx context.Context, userID string) (*types.Session, error) {
+	return &types.Session{ID: userID, Email: userID + "@example.com"}, nil
+}
+
+func (f *fakeUsers) GetNotifications(ctx context.Context, userID string) (*types.Notifications, error) {
+	return &f.notifications, nil
+}
+
+type fakeTransfers struct {
+	db.TransferStore
+	transfer types.Transfer
+}
+
+func (f *fakeTransfers) GetTransfer(ctx context.Context, id string) (*types.Transfer, error) {
+	return &f.transfer, nil
+}
+
+type sentMail struct {
+	subject, to, body string
+}
+
+func newTestNotifier(t *testing.T, notifications types.Notifications, transfer types.Transfer) (*Notifier, *[]sentMail) {
+	t.Helper()
+
+	notifier, err := NewNotifier(&fakeUsers{notifications: notifications}, &fakeTransfers{transfer: transfer}, "../../templates/transferNotification.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	sent := &[]sentMail{}
+	notifier.send = func(subject, to, body string) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		*sent = append(*sent, sentMail{subject, to, body})
+		return nil
+	}
+
+	return notifier, sent
+}
+
+func TestDownloaded(t *testing.T) {
+	first := types.Transfer{ID: "abc", UserID: "sender", Filename: "report.pdf", Downloads: []types.Download{{Username: "bob"}}}
+	second := first
+	second.Downloads = append(second.Downloads, types.Download{})
+
+	tests := []struct {
+		name          string
+		notifications types.Notifications
+		transfer      types.Transfer
+		sent          int
+	}{
+		{"disabled", types.Notifications{}, first, 0},
+		{"first download", types.Notifications{FirstDownload: true}, first, 1},
+		{"only the first download", types.Notifications{FirstDownload: true}, second, 0},
+		{"every download", types.Notifications{EveryDownload: true}, second, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			notifier, sent := newTestNotifier(t, test.notifications, test.transfer)
+			notifier.Downloaded("abc")
+			notifier.Wait()
+
+			if len(*sent) != test.sent {
+				t.Fatalf("expected %d emails, got %d", test.sent, len(*sent))
+			}
+			if test.sent == 0 {
+				return
+			}
+			mail := (*sent)[0]
+			if mail.to != "sender@example.com" {
+				t.Errorf("expected email to the sender, got %s", mail.to)
+			}
+			if !strings.Contains(mail.body, "report.pdf") {
+				t.Errorf("expected the filename in the email, got %s", mail.body)
+			}
+		})
+	}
+}
+
+func TestExpired(t *testing.T) {
+	notifier, sent := newTestNotifier(t, types.Notifications{Expired: true}, types.Transfer{})
+
+	expired := tunnel.StreamDetails{UserID: "sender", Filename: "report.pdf", Expires: time.Now().Add(-time.Second)}
+	downloaded := expired
+	downloaded.Downloads = 1
+	revoked := expired
+	revoked.Expires = time.Now().Add(time.Minute)
+
+	notifier.Expired(downloaded)
+	notifier.Expired(revoked)
+	notifier.Expired(expired)
+	notifier.Wait()
+
+	if len(*sent) != 1 {
+		t.Fatalf("expected 1 email, got %d", len(*sent))
+	}
+	if (*sent)[0].subject != "Your link expired" {
+		t.Errorf("unexpected subject %q", (*sent)[0].subject)
+	}
+}
+
+func TestDelivered(t *testing.T) {
+	notifier, sent := newTestNotifier(t, types.Notifications{Inbox: true}, types.Transfer{})
+
+	notifier.Delivered("bob", tunnel.StreamDetails{
+		Username: "alice",
+		Filename: "build.tar",
+		Expires:  time.Now().Add(time.Hour),
+	})
+	notifier.Wait()
+
+	if len(*sent) != 1 || (*sent)[0].to != "bob@example.com" {
+		t.Fatalf("expected one email to bob, got %v", *sent)
+	}
+	if body := (*sent)[0].body; !strings.Contains(body, "alice sent you a file") || !strings.Contains(body, "/inbox") {
+		t.Errorf("expected the email to name the sender and link the inbox, got %s", body)
+	}
+}
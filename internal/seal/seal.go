@@ -0,0 +1,396 @@
+// Package seal encrypts streams in chunks with AES-256-GCM, so they can be
+// encrypted and decrypted without holding them in memory.
+//
+// A sealed stream starts with Magic and a random nonce prefix, followed by
+// the chunks. Every chunk holds ChunkSize bytes of the plaintext except the
+// last one, which may be shorter or empty. The nonce of a chunk is the
+// prefix, its index and a byte marking the last chunk, so chunks can not
+// be reordered, dropped or truncated without failing to open.
+package seal
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// Magic starts every sealed stream.
+	Magic = "TRISEAL1"
+	// KeySize is the size of the keys, AES-256.
+	KeySize = 32
+	// ChunkSize is the amount of plaintext sealed in each chunk.
+	ChunkSize = 64 * 1024
+
+	prefixSize = 7
+	headerSize = len(Magic) + prefixSize
+	tagSize    = 16
+)
+
+var (
+	ErrInvalidKey = errors.New("seal: invalid key")
+	ErrNotSealed  = errors.New("seal: not a sealed stream")
+	// ErrCorrupted is returned when a chunk was altered, reordered or the
+	// stream ends before its last chunk.
+	ErrCorrupted = errors.New("seal: stream corrupted or wrong key")
+)
+
+// NewKey returns a random key.
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// EncodeKey returns the key in a form that fits in a URL fragment.
+func EncodeKey(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+
+	return key, nil
+}
+
+// SealedSize returns the size of the sealed stream of size bytes.
+func SealedSize(size int64) int64 {
+	chunks := max((size+ChunkSize-1)/ChunkSize, 1)
+	return int64(headerSize) + size + chunks*tagSize
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 0, prefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, index)
+	if last {
+		return append(nonce, 1)
+	}
+
+	return append(nonce, 0)
+}
+
+type writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint32
+	buf    []byte
+	sealed []byte
+	closed bool
+}
+
+// NewWriter seals everything written to it into w. Close has to be called
+// to write the last chunk, it does not close w.
+func NewWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, prefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, Magic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+
+	return &writer{
+		w:      w,
+		aead:   aead,
+		prefix: prefix,
+		buf:    make([]byte, 0, ChunkSize),
+		sealed: make([]byte, 0, ChunkSize+tagSize),
+	}, nil
+}
+
+func (sw *writer) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, errors.New("seal: write after close")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data shows it is not the last
+		if len(sw.buf) == ChunkSize {
+			if err := sw.flush(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(sw.buf[len(sw.buf):ChunkSize], p)
+		sw.buf = sw.buf[:len(sw.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (sw *writer) flush(last bool) error {
+	if sw.index == ^uint32(0) {
+		return errors.New("seal: stream too long")
+	}
+
+	sw.sealed = sw.aead.Seal(sw.sealed[:0], chunkNonce(sw.prefix, sw.index, last), sw.buf, nil)
+	sw.index++
+	sw.buf = sw.buf[:0]
+
+	_, err := sw.w.Write(sw.sealed)
+	return err
+}
+
+// Close writes the last chunk.
+func (sw *writer) Close() error {
+	if sw.closed {
+		return nil
+	}
+	sw.closed = true
+
+	return sw.flush(true)
+}
+
+type reader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint32
+	sealed []byte
+	plain  []byte
+	done   bool
+	err    error
+}
+
+// NewReader opens the sealed stream read from r.
+func NewReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrNotSealed
+		}
+		return nil, err
+	}
+	if string(header[:len(Magic)]) != Magic {
+		return nil, ErrNotSealed
+	}
+
+	return &reader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		prefix: header[len(Magic):],
+		sealed: make([]byte, ChunkSize+tagSize),
+	}, nil
+}
+
+func (sr *reader) Read(p []byte) (int, error) {
+	for len(sr.plain) == 0 {
+		if sr.err != nil {
+			return 0, sr.err
+		}
+		if sr.done {
+			return 0, io.EOF
+		}
+		sr.err = sr.next()
+	}
+
+	n := copy(p, sr.plain)
+	sr.plain = sr.plain[n:]
+
+	return n, nil
+}
+
+// next opens the following chunk, it is the last one when the stream
+// ends with it.
+func (sr *reader) next() error {
+	n, err := io.ReadFull(sr.r, sr.sealed)
+	last := errors.Is(err, io.ErrUnexpectedEOF)
+	if errors.Is(err, io.EOF) {
+		return ErrCorrupted
+	} else if err != nil && !last {
+		return err
+	}
+	if !last {
+		if _, err := sr.r.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plain, err := sr.aead.Open(sr.sealed[:0], chunkNonce(sr.prefix, sr.index, last), sr.sealed[:n], nil)
+	if err != nil {
+		return ErrCorrupted
+	}
+	sr.index++
+	sr.plain = plain
+	sr.done = last
+
+	return nil
+}
+
+// PlainSize returns the size of the plaintext of a sealed stream of
+// sealedSize bytes.
+func PlainSize(sealedSize int64) (int64, error) {
+	body := sealedSize - int64(headerSize)
+	if body < tagSize {
+		return 0, ErrNotSealed
+	}
+
+	chunks := body / (ChunkSize + tagSize)
+	rest := body % (ChunkSize + tagSize)
+	if rest == 0 {
+		return chunks * ChunkSize, nil
+	} else if rest < tagSize {
+		return 0, ErrCorrupted
+	}
+
+	return chunks*ChunkSize + rest - tagSize, nil
+}
+
+// Seeker opens a sealed stream with random access, only the chunk holding
+// the current offset is decrypted.
+type Seeker struct {
+	r      io.ReadSeeker
+	aead   cipher.AEAD
+	prefix []byte
+	size   int64
+	last   int64
+	offset int64
+	// index is the chunk held in plain, -1 before the first read
+	index  int64
+	sealed []byte
+	plain  []byte
+}
+
+// NewSeeker opens the sealed stream of sealedSize bytes read from r.
+func NewSeeker(r io.ReadSeeker, sealedSize int64, key []byte) (*Seeker, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	size, err := PlainSize(sealedSize)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrNotSealed
+	}
+	if string(header[:len(Magic)]) != Magic {
+		return nil, ErrNotSealed
+	}
+
+	return &Seeker{
+		r:      r,
+		aead:   aead,
+		prefix: header[len(Magic):],
+		size:   size,
+		last:   max((size+ChunkSize-1)/ChunkSize-1, 0),
+		index:  -1,
+		sealed: make([]byte, ChunkSize+tagSize),
+	}, nil
+}
+
+// Size returns the size of the plaintext.
+func (s *Seeker) Size() int64 {
+	return s.size
+}
+
+func (s *Seeker) Read(p []byte) (int, error) {
+	if s.offset >= s.size {
+		return 0, io.EOF
+	}
+
+	index := s.offset / ChunkSize
+	if index != s.index {
+		if err := s.load(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.plain[s.offset-index*ChunkSize:])
+	s.offset += int64(n)
+
+	return n, nil
+}
+
+func (s *Seeker) load(index int64) error {
+	s.index = -1
+
+	start := int64(headerSize) + index*(ChunkSize+tagSize)
+	if _, err := s.r.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	sealed := s.sealed
+	if index == s.last {
+		sealed = sealed[:s.size-index*ChunkSize+tagSize]
+	}
+	if _, err := io.ReadFull(s.r, sealed); err != nil {
+		return ErrCorrupted
+	}
+
+	plain, err := s.aead.Open(s.plain[:0], chunkNonce(s.prefix, uint32(index), index == s.last), sealed, nil)
+	if err != nil {
+		return ErrCorrupted
+	}
+	s.plain = plain
+	s.index = index
+
+	return nil
+}
+
+func (s *Seeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("seal: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("seal: negative position")
+	}
+
+	s.offset = offset
+	return offset, nil
+}
@@ -0,0 +1,116 @@
+package seal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func sealBytes(t *testing.T, key, plain []byte) []byte {
+	t.Helper()
+
+	var sealed bytes.Buffer
+	w, err := NewWriter(&sealed, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return sealed.Bytes()
+}
+
+func openBytes(key, sealed []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	key, _ := NewKey()
+
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3 * ChunkSize} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		sealed := sealBytes(t, key, plain)
+		if int64(len(sealed)) != SealedSize(int64(size)) {
+			t.Errorf("size %d: expected %d sealed bytes, got %d", size, SealedSize(int64(size)), len(sealed))
+		}
+
+		opened, err := openBytes(key, sealed)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(opened, plain) {
+			t.Errorf("size %d: opened stream differs from the plaintext", size)
+		}
+	}
+}
+
+func TestTamperedStreams(t *testing.T) {
+	key, _ := NewKey()
+	plain := make([]byte, 2*ChunkSize+10)
+	sealed := sealBytes(t, key, plain)
+
+	flipped := bytes.Clone(sealed)
+	flipped[len(flipped)-1] ^= 1
+
+	tests := map[string][]byte{
+		"flipped bit": flipped,
+		// cut right after the first chunk, which is not the last one
+		"truncated": sealed[:headerSize+ChunkSize+tagSize],
+	}
+	for name, stream := range tests {
+		if _, err := openBytes(key, stream); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%s: expected ErrCorrupted, got %v", name, err)
+		}
+	}
+
+	other, _ := NewKey()
+	if _, err := openBytes(other, sealed); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("expected ErrCorrupted with another key, got %v", err)
+	}
+	if _, err := openBytes(key, []byte("plain text file")); !errors.Is(err, ErrNotSealed) {
+		t.Errorf("expected ErrNotSealed, got %v", err)
+	}
+}
+
+func TestSeeker(t *testing.T) {
+	key, _ := NewKey()
+	plain := make([]byte, 2*ChunkSize+100)
+	rand.Read(plain)
+	sealed := sealBytes(t, key, plain)
+
+	seeker, err := NewSeeker(bytes.NewReader(sealed), int64(len(sealed)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seeker.Size() != int64(len(plain)) {
+		t.Fatalf("expected size %d, got %d", len(plain), seeker.Size())
+	}
+
+	// reads across the end of a chunk and from the last chunk
+	for _, offset := range []int64{ChunkSize - 10, 2*ChunkSize + 50, 0} {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(io.LimitReader(seeker, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := plain[offset:min(offset+100, int64(len(plain)))]
+		if !bytes.Equal(got, want) {
+			t.Errorf("offset %d: read differs from the plaintext", offset)
+		}
+	}
+}
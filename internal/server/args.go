@@ -0,0 +1,253 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"trisend/internal/archive"
+	"trisend/internal/config"
+)
+
+const usageFormat = `Usage: ssh trisend [options] <filename> < <filepath>
+       ssh trisend get [--password <password>] <id> > <filepath>
+
+Options:
+  --expires <duration>   link lifetime, e.g. 30m or 2h (default %s, max %s)
+  --downloads <n>        amount of recipients that can download the file (default 1)
+  --name <name>          filename shown to recipients
+  --size <bytes>         size of the file, used to estimate the time left
+  --message <text>       message shown on the download page
+  --to <user>            username or email allowed to download, can be repeated,
+                         the transfer is sent to their inbox
+  --public               anyone with the link can download, no account required
+  --password <password>  anyone with the link and the password can download
+  --format <format>      wrap the file in a zip, tar, tar.gz or tar.zst archive
+  --zip                  shorthand for --format zip
+  --sealed               the file was encrypted with seal, recipients decrypt it
+                         with the key appended to the link
+  --sha256 <hash>        expected SHA-256 of the file, the transfer is aborted
+                         when the upload does not match
+
+Commands:
+  get <id>               write a transfer sent to you to stdout, also
+                         available with sftp get <id>
+  help                   show this message
+`
+
+func usage() string {
+	return fmt.Sprintf(usageFormat, config.DEFAULT_EXPIRY, config.MAX_EXPIRY)
+}
+
+// errHelp is returned when the sender asked for the usage message.
+var errHelp = errors.New("help requested")
+
+type uploadOptions struct {
+	Filename     string
+	Name         string
+	Message      string
+	Expires      time.Duration
+	MaxDownloads int
+	// Size is the expected size of the upload, 0 when unknown.
+	Size     int64
+	To       []string
+	Public   bool
+	Password string
+	// Format is the archive the file is wrapped in, empty to send it as is.
+	Format archive.Format
+	// Sealed uploads are encrypted end to end, the server never sees the key.
+	Sealed bool
+	// SHA256 is the hex digest the upload must match, empty to skip the check.
+	SHA256 string
+}
+
+// parseUploadArgs parses the command of an upload session, flags can be
+// placed before or after the filename.
+func parseUploadArgs(args []string) (*uploadOptions, error) {
+	if len(args) > 0 && args[0] == "help" {
+		return nil, errHelp
+	}
+
+	opts := &uploadOptions{}
+	recipients := listFlag{}
+
+	flags := flag.NewFlagSet("trisend", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.Usage = func() {}
+	flags.DurationVar(&opts.Expires, "expires", config.DEFAULT_EXPIRY, "")
+	flags.IntVar(&opts.MaxDownloads, "downloads", 1, "")
+	flags.IntVar(&opts.MaxDownloads, "max-downloads", 1, "")
+	flags.StringVar(&opts.Name, "name", "", "")
+	flags.Int64Var(&opts.Size, "size", 0, "")
+	flags.StringVar(&opts.Message, "message", "", "")
+	flags.Var(&recipients, "to", "")
+	flags.BoolVar(&opts.Public, "public", false, "")
+	flags.StringVar(&opts.Password, "password", "", "")
+	flags.Func("format", "", func(value string) error {
+		format, err := archive.ParseFormat(value)
+		opts.Format = format
+		return err
+	})
+	flags.BoolFunc("zip", "", func(string) error {
+		opts.Format = archive.Zip
+		return nil
+	})
+	// deprecated, files are sent as is by default now; kept so existing
+	// scripts do not break
+	flags.BoolFunc("no-zip", "", func(string) error {
+		opts.Format = ""
+		return nil
+	})
+	flags.BoolVar(&opts.Sealed, "sealed", false, "")
+	flags.StringVar(&opts.SHA256, "sha256", "", "")
+
+	positional := []string{}
+	for {
+		if err := flags.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, errHelp
+			}
+			return nil, parseError(err)
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+
+	if len(positional) == 0 {
+		return nil, fmt.Errorf("missing filename")
+	} else if len(positional) > 1 {
+		return nil, fmt.Errorf("unexpected argument: %s", positional[1])
+	}
+
+	opts.Filename = filepath.Base(positional[0])
+	opts.Name = filepath.Base(opts.Name)
+	opts.To = recipients
+
+	if trimExt(opts.Filename) == "" {
+		return nil, fmt.Errorf("invalid filename: %s", positional[0])
+	}
+	if opts.Name == "." {
+		opts.Name = ""
+	}
+	if opts.Expires <= 0 {
+		return nil, fmt.Errorf("--expires must be a positive duration")
+	} else if opts.Expires > config.MAX_EXPIRY {
+		return nil, fmt.Errorf("--expires can not be longer than %s", config.MAX_EXPIRY)
+	}
+	if opts.Size < 0 {
+		return nil, fmt.Errorf("--size can not be negative")
+	}
+	if opts.MaxDownloads < 1 {
+		return nil, fmt.Errorf("--downloads must be at least 1")
+	}
+	if len(opts.To) > 0 && (opts.Public || opts.Password != "") {
+		return nil, fmt.Errorf("--to can not be combined with --public or --password")
+	}
+	if opts.Sealed && opts.Format != "" {
+		return nil, fmt.Errorf("--sealed files can not be wrapped in an archive, seal the archive instead")
+	}
+	if opts.SHA256 != "" {
+		opts.SHA256 = strings.ToLower(opts.SHA256)
+		if digest, err := hex.DecodeString(opts.SHA256); err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("--sha256 must be a hex encoded SHA-256 digest")
+		}
+	}
+
+	return opts, nil
+}
+
+type getOptions struct {
+	ID string
+	// Password unlocks transfers protected with --password.
+	Password string
+}
+
+// parseGetArgs parses the command of a download session, args start after
+// the get command.
+func parseGetArgs(args []string) (*getOptions, error) {
+	opts := &getOptions{}
+
+	flags := flag.NewFlagSet("trisend get", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.Usage = func() {}
+	flags.StringVar(&opts.Password, "password", "", "")
+
+	positional := []string{}
+	for {
+		if err := flags.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, errHelp
+			}
+			return nil, parseError(err)
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+
+	if len(positional) == 0 {
+		return nil, fmt.Errorf("missing transfer id")
+	} else if len(positional) > 1 {
+		return nil, fmt.Errorf("unexpected argument: %s", positional[1])
+	}
+
+	// the link printed to the sender works as well
+	opts.ID = path.Base(positional[0])
+
+	return opts, nil
+}
+
+// DisplayName returns the filename recipients see.
+func (opts *uploadOptions) DisplayName() string {
+	if opts.Name != "" {
+		return opts.Name
+	}
+
+	return opts.Filename
+}
+
+// parseError turns the errors of the flag package into messages using
+// the double dash notation of the usage message.
+func parseError(err error) error {
+	msg := err.Error()
+	if name, ok := strings.CutPrefix(msg, "flag provided but not defined: -"); ok {
+		return fmt.Errorf("unknown flag: --%s", name)
+	}
+	if name, ok := strings.CutPrefix(msg, "flag needs an argument: -"); ok {
+		return fmt.Errorf("flag needs an argument: --%s", name)
+	}
+
+	return errors.New(strings.Replace(msg, " -", " --", 1))
+}
+
+func trimExt(filename string) string {
+	return filename[:len(filename)-len(filepath.Ext(filename))]
+}
+
+// listFlag collects a flag given several times or as a comma separated list.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"trisend/internal/archive"
+)
+
+func TestParseUploadArgs(t *testing.T) {
+	opts, err := parseUploadArgs([]string{"--downloads", "3", "report.pdf", "--to", "alice,bob@mail.com", "--expires", "1h", "--zip"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if opts.Filename != "report.pdf" {
+		t.Errorf("expected filename report.pdf, got %s", opts.Filename)
+	}
+	if opts.MaxDownloads != 3 {
+		t.Errorf("expected 3 downloads, got %d", opts.MaxDownloads)
+	}
+	if len(opts.To) != 2 || opts.To[0] != "alice" || opts.To[1] != "bob@mail.com" {
+		t.Errorf("expected recipients [alice bob@mail.com], got %v", opts.To)
+	}
+	if opts.Expires != time.Hour {
+		t.Errorf("expected expiry of 1h, got %v", opts.Expires)
+	}
+	if opts.Format != archive.Zip {
+		t.Errorf("expected --zip to select the zip format, got %q", opts.Format)
+	}
+}
+
+func TestParseUploadArgsNoZip(t *testing.T) {
+	opts, err := parseUploadArgs([]string{"report.pdf", "--no-zip"})
+	if err != nil {
+		t.Fatalf("expected the deprecated --no-zip to be accepted, got %v", err)
+	}
+	if opts.Format != "" {
+		t.Errorf("expected --no-zip to send the file as is, got %q", opts.Format)
+	}
+}
+
+func TestParseUploadArgsErrors(t *testing.T) {
+	tests := map[string][]string{
+		"unknown flag":      {"--bogus", "file.txt"},
+		"missing filename":  {"--public"},
+		"extra argument":    {"a.txt", "b.txt"},
+		"invalid downloads": {"--downloads", "0", "file.txt"},
+		"to with public":    {"--to", "alice", "--public", "file.txt"},
+		"unknown format":    {"--format", "rar", "file.txt"},
+		"sealed archive":    {"--sealed", "--zip", "file.txt"},
+		"invalid sha256":    {"--sha256", "abc", "file.txt"},
+	}
+
+	for name, args := range tests {
+		if _, err := parseUploadArgs(args); err == nil {
+			t.Errorf("%s: expected an error for %v", name, args)
+		}
+	}
+
+	if _, err := parseUploadArgs([]string{"help"}); !errors.Is(err, errHelp) {
+		t.Errorf("expected errHelp for the help command, got %v", err)
+	}
+}
+
+func TestParseGetArgs(t *testing.T) {
+	opts, err := parseGetArgs([]string{"https://trisend.dev/download/abc", "--password", "secret"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if opts.ID != "abc" {
+		t.Errorf("expected id abc, got %s", opts.ID)
+	}
+	if opts.Password != "secret" {
+		t.Errorf("expected password secret, got %s", opts.Password)
+	}
+
+	if _, err := parseGetArgs(nil); err == nil {
+		t.Error("expected an error without a transfer id")
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+	"trisend/internal/config"
+	"trisend/internal/tunnel"
+)
+
+// tempPattern names the temp files and staging directories of uploads
+const tempPattern = "trisend-*"
+
+// JanitorStats counts what the janitor cleaned up since the server started.
+type JanitorStats struct {
+	Streams   int64
+	Spools    int64
+	TempFiles int64
+}
+
+// janitor periodically evicts expired transfers, which wakes up their
+// senders, and deletes spools and temp files left behind by crashed or
+// killed sessions.
+type janitor struct {
+	registry tunnel.Registry
+	interval time.Duration
+	tempDir  string
+	// maxAge is how long temp files are kept without being written to,
+	// senders can not keep a link open any longer
+	maxAge time.Duration
+
+	streams   atomic.Int64
+	spools    atomic.Int64
+	tempFiles atomic.Int64
+}
+
+func newJanitor(registry tunnel.Registry, interval time.Duration) *janitor {
+	return &janitor{
+		registry: registry,
+		interval: interval,
+		tempDir:  os.TempDir(),
+		maxAge:   config.MAX_EXPIRY,
+	}
+}
+
+// run sweeps right away, spools orphaned by a restart can not be decrypted
+// anymore, and then every interval until ctx is done.
+func (j *janitor) run(ctx context.Context) {
+	j.sweep(ctx)
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			j.sweep(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (j *janitor) sweep(ctx context.Context) {
+	before := time.Now().Add(-j.maxAge)
+
+	streams, spools, err := j.registry.Purge(ctx, before)
+	if err != nil {
+		slog.Error(err.Error())
+	}
+
+	tempFiles, err := j.purgeTempFiles(before)
+	if err != nil {
+		slog.Error(err.Error())
+	}
+
+	j.streams.Add(int64(streams))
+	j.spools.Add(int64(spools))
+	j.tempFiles.Add(int64(tempFiles))
+
+	if streams > 0 || spools > 0 || tempFiles > 0 {
+		slog.Info(fmt.Sprintf("Janitor purged %d streams, %d spools and %d temp files", streams, spools, tempFiles))
+	}
+}
+
+// purgeTempFiles removes the temp files and staging directories nothing
+// was written to since before.
+func (j *janitor) purgeTempFiles(before time.Time) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(j.tempDir, tempPattern))
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, path := range paths {
+		modified, err := lastModified(path)
+		if err != nil || modified.After(before) {
+			continue
+		}
+
+		if err := os.RemoveAll(path); err != nil {
+			slog.Error(err.Error())
+			continue
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+// lastModified returns the latest modification time of path, directories
+// are as recent as the newest file they hold.
+func lastModified(path string) (time.Time, error) {
+	var modified time.Time
+	err := filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+
+		return nil
+	})
+
+	return modified, err
+}
+
+func (j *janitor) stats() JanitorStats {
+	return JanitorStats{
+		Streams:   j.streams.Load(),
+		Spools:    j.spools.Load(),
+		TempFiles: j.tempFiles.Load(),
+	}
+}
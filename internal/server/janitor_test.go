@@ -0,0 +1,55 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPurgeTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	j := &janitor{tempDir: dir}
+
+	stale := filepath.Join(dir, "trisend-1.temp")
+	staging := filepath.Join(dir, "trisend-2")
+	active := filepath.Join(staging, "file-1")
+	other := filepath.Join(dir, "other.temp")
+	for _, path := range []string{stale, other} {
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(staging, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(active, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-time.Hour)
+	for _, path := range []string{stale, staging, other} {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	purged, err := j.purgeTempFiles(time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Errorf("expected 1 purged temp file, got %d", purged)
+	}
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("expected stale temp file to be removed")
+	}
+	// the staging directory still receives files
+	if _, err := os.Stat(active); err != nil {
+		t.Errorf("expected active staging directory to be kept, got %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("expected unrelated file to be kept, got %v", err)
+	}
+}
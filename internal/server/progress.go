@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+	"trisend/internal/tunnel"
+	"trisend/internal/util"
+)
+
+const (
+	// ptyInterval is how often the progress line is redrawn on a terminal
+	ptyInterval = time.Millisecond * 250
+	// logInterval is how often a progress line is printed without a terminal
+	logInterval = time.Second * 5
+	// publishInterval is how often recipients are told about the progress
+	publishInterval = time.Millisecond * 500
+)
+
+// progress reports the state of an upload to the sender. With a PTY it
+// keeps redrawing a single line, otherwise it prints a line now and then
+// so logs of scripted uploads stay readable.
+type progress struct {
+	mutex    sync.Mutex
+	w        io.Writer
+	pty      bool
+	interval time.Duration
+	total    int64
+	written  int64
+	started  time.Time
+	drawn    time.Time
+	// key is the transfer whose recipients follow the progress
+	key       string
+	registry  tunnel.Registry
+	published time.Time
+}
+
+// newProgress reports to w, total is the expected size of the upload or
+// 0 when it is not known.
+func newProgress(w io.Writer, pty bool, total int64) *progress {
+	interval := logInterval
+	if pty {
+		interval = ptyInterval
+	}
+
+	return &progress{
+		w:        w,
+		pty:      pty,
+		interval: interval,
+		total:    total,
+	}
+}
+
+// waitRecipient runs wait, which blocks until a recipient takes the
+// stream, telling the sender how long the link is still valid meanwhile.
+func (p *progress) waitRecipient(wait func() (*tunnel.Stream, error), expires time.Duration) (*tunnel.Stream, error) {
+	deadline := time.Now().Add(expires)
+
+	type result struct {
+		stream *tunnel.Stream
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		stream, err := wait()
+		done <- result{stream, err}
+	}()
+
+	interval := p.interval
+	if !p.pty {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	p.print(waitingLine(expires))
+	for {
+		select {
+		case recipient := <-done:
+			if recipient.err == nil {
+				p.print("Recipient connected, uploading")
+			}
+			p.finishLine()
+			return recipient.stream, recipient.err
+		case <-ticker.C:
+			p.print(waitingLine(time.Until(deadline)))
+		}
+	}
+}
+
+func waitingLine(left time.Duration) string {
+	return fmt.Sprintf("Waiting for a recipient, link expires in %s", util.FormatDuration(left))
+}
+
+// publish shares the progress with the recipients of the transfer.
+func (p *progress) publish(registry tunnel.Registry, key string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.registry = registry
+	p.key = key
+}
+
+// Reader counts what is read through r as uploaded.
+func (p *progress) Reader(r io.Reader) io.Reader {
+	return &progressReader{r: r, progress: p}
+}
+
+func (p *progress) add(amount int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	if p.started.IsZero() {
+		p.started = now
+		p.drawn = now
+	}
+	p.written += int64(amount)
+
+	if p.key != "" && now.Sub(p.published) >= publishInterval {
+		p.published = now
+		p.registry.SetUploaded(p.key, p.written)
+	}
+
+	if now.Sub(p.drawn) < p.interval {
+		return
+	}
+	p.drawn = now
+	p.draw(p.line(now.Sub(p.started)))
+}
+
+// done prints the summary of the upload.
+func (p *progress) done() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	elapsed := time.Since(p.started)
+	if p.started.IsZero() {
+		elapsed = 0
+	}
+
+	if p.key != "" {
+		p.registry.SetUploaded(p.key, p.written)
+	}
+
+	line := fmt.Sprintf("Uploaded %s", util.FormatBytes(p.written))
+	if elapsed >= time.Second {
+		line += fmt.Sprintf(" in %s (%s/s)", util.FormatDuration(elapsed), util.FormatBytes(p.rate(elapsed)))
+	}
+	p.draw(line)
+	p.finishLine()
+}
+
+// line renders the amount uploaded, the throughput and the time left.
+func (p *progress) line(elapsed time.Duration) string {
+	parts := []string{fmt.Sprintf("Uploaded %s", util.FormatBytes(p.written))}
+	if p.total > 0 {
+		parts[0] += fmt.Sprintf(" of %s (%d%%)", util.FormatBytes(p.total), min(p.written*100/p.total, 100))
+	}
+
+	rate := p.rate(elapsed)
+	if rate > 0 {
+		parts = append(parts, fmt.Sprintf("%s/s", util.FormatBytes(rate)))
+		if p.total > p.written {
+			left := time.Duration(float64(p.total-p.written) / float64(rate) * float64(time.Second))
+			parts = append(parts, fmt.Sprintf("%s left", util.FormatDuration(max(left, time.Second))))
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func (p *progress) rate(elapsed time.Duration) int64 {
+	if elapsed < time.Second {
+		return 0
+	}
+
+	return int64(float64(p.written) / elapsed.Seconds())
+}
+
+func (p *progress) print(line string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.draw(line)
+}
+
+// draw writes a line, on a terminal it replaces the current line.
+func (p *progress) draw(line string) {
+	if p.pty {
+		fmt.Fprintf(p.w, "\r\033[K%s", line)
+		return
+	}
+	fmt.Fprintln(p.w, line)
+}
+
+// finishLine moves past the line being redrawn on a terminal.
+func (p *progress) finishLine() {
+	if p.pty {
+		fmt.Fprintln(p.w)
+	}
+}
+
+// crlfWriter turns line feeds into carriage return line feeds.
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+type progressReader struct {
+	r        io.Reader
+	progress *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.progress.add(n)
+
+	return n, err
+}
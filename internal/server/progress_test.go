@@ -0,0 +1,23 @@
+package server
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestProgressLine(t *testing.T) {
+	p := newProgress(io.Discard, false, 4<<20)
+	p.written = 1 << 20
+
+	expected := "Uploaded 1.00 MB of 4.00 MB (25%), 512.00 KB/s, 6 seconds left"
+	if line := p.line(time.Second * 2); line != expected {
+		t.Errorf("expected %q, got %q", expected, line)
+	}
+
+	p.total = 0
+	expected = "Uploaded 1.00 MB, 512.00 KB/s"
+	if line := p.line(time.Second * 2); line != expected {
+		t.Errorf("expected %q, got %q", expected, line)
+	}
+}
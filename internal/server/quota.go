@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"trisend/internal/db"
+	"trisend/internal/types"
+	"trisend/internal/util"
+)
+
+// uploadQuota tracks the limits applied to a single upload of a user. The
+// bytes the upload may have are reserved from the daily quota up front,
+// what is left unused is given back when it ends.
+type uploadQuota struct {
+	userStore db.UserStore
+	userID    string
+	quota     *types.Quota
+	day       time.Time
+	used      int64
+	reserved  int64
+}
+
+// acquireQuota loads the user's quota and reserves one of its concurrent
+// transfers, the returned error is meant to be shown to the client.
+func acquireQuota(ctx context.Context, userStore db.UserStore, userID string) (*uploadQuota, error) {
+	quota, err := userStore.GetQuota(ctx, userID)
+	if err != nil {
+		slog.Error(err.Error())
+		return nil, defaultError
+	}
+
+	ok, err := userStore.AcquireTransfer(ctx, userID, quota.ConcurrentTransfers)
+	if err != nil {
+		slog.Error(err.Error())
+		return nil, defaultError
+	}
+	if !ok {
+		return nil, fmt.Errorf("Limit REACHED: %d concurrent transfers", quota.ConcurrentTransfers)
+	}
+
+	q := &uploadQuota{
+		userStore: userStore,
+		userID:    userID,
+		quota:     quota,
+		day:       time.Now(),
+	}
+
+	// a single upload never needs more than the max file size, so the
+	// reservation leaves the rest of the day to concurrent uploads
+	size := quota.MaxFileSize
+	if size <= 0 {
+		size = quota.DailyBytes
+	}
+	if size > 0 {
+		q.reserved, q.used, err = userStore.ReserveDailyUsage(ctx, userID, q.day, size, quota.DailyBytes)
+		if err != nil {
+			slog.Error(err.Error())
+			q.release()
+			return nil, defaultError
+		}
+		if q.reserved == 0 {
+			q.release()
+			return nil, q.limitError()
+		}
+	}
+
+	return q, nil
+}
+
+// release gives back the concurrent transfer, and the reserved bytes when
+// the upload was not committed.
+func (q *uploadQuota) release() {
+	q.refund(q.reserved)
+	q.reserved = 0
+
+	if err := q.userStore.ReleaseTransfer(context.Background(), q.userID); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+func (q *uploadQuota) refund(size int64) {
+	if size <= 0 {
+		return
+	}
+	if err := q.userStore.RefundDailyUsage(context.Background(), q.userID, q.day, size); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+// remaining returns how many bytes the upload may have, -1 means unlimited.
+func (q *uploadQuota) remaining() int64 {
+	if q.quota.MaxFileSize <= 0 && q.quota.DailyBytes <= 0 {
+		return -1
+	}
+
+	return q.reserved
+}
+
+func (q *uploadQuota) exceeded(size int64) bool {
+	remaining := q.remaining()
+	return remaining >= 0 && size > remaining
+}
+
+func (q *uploadQuota) limitError() error {
+	limits := []string{}
+	if q.quota.MaxFileSize > 0 {
+		limits = append(limits, fmt.Sprintf("max file size is %s", util.FormatBytes(q.quota.MaxFileSize)))
+	}
+	if q.quota.DailyBytes > 0 {
+		dailyLeft := max(q.quota.DailyBytes-q.used, 0)
+		limits = append(limits, fmt.Sprintf("%s of your daily %s remaining", util.FormatBytes(dailyLeft), util.FormatBytes(q.quota.DailyBytes)))
+	}
+
+	return fmt.Errorf("Limit REACHED: %s", strings.Join(limits, ", "))
+}
+
+// commit keeps the bytes of a finished upload in the daily usage, gives
+// the rest of the reservation back and returns a message with the quota
+// left for today.
+func (q *uploadQuota) commit(size int64) string {
+	if size > q.reserved {
+		// nothing was reserved for an unlimited quota, and a relay cut short
+		// already sent more, the usage is kept anyway
+		if _, _, err := q.userStore.ReserveDailyUsage(context.Background(), q.userID, q.day, size-q.reserved, 0); err != nil {
+			slog.Error(err.Error())
+		}
+	} else {
+		q.refund(q.reserved - size)
+	}
+	q.reserved = 0
+	q.used += size
+
+	if q.quota.DailyBytes <= 0 {
+		return "Daily quota: unlimited"
+	}
+
+	dailyLeft := max(q.quota.DailyBytes-q.used, 0)
+	return fmt.Sprintf("Daily quota: %s of %s remaining", util.FormatBytes(dailyLeft), util.FormatBytes(q.quota.DailyBytes))
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"trisend/internal/db"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestQuota returns a user store where the user bob has the given
+// limits, 0 for unlimited.
+func newTestQuota(t *testing.T, maxFileSize, dailyBytes string) db.UserStore {
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	rdb.HSet(context.Background(), "user:bob", map[string]string{
+		"max_file_size":        maxFileSize,
+		"daily_bytes":          dailyBytes,
+		"concurrent_transfers": "10",
+	})
+
+	return db.NewUserRedisStore(rdb)
+}
+
+func TestAcquireQuotaReservesConcurrently(t *testing.T) {
+	userStore := newTestQuota(t, "6", "20")
+	ctx := context.Background()
+
+	// 5 uploads of up to 6 bytes race for 20 bytes, the last one gets 2
+	quotas := make(chan *uploadQuota, 5)
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if quota, err := acquireQuota(ctx, userStore, "bob"); err == nil {
+				quotas <- quota
+			}
+		}()
+	}
+	wg.Wait()
+	close(quotas)
+
+	var reserved int64
+	acquired := []*uploadQuota{}
+	for quota := range quotas {
+		reserved += quota.remaining()
+		acquired = append(acquired, quota)
+	}
+	if len(acquired) != 4 || reserved != 20 {
+		t.Fatalf("expected 4 uploads to share 20 bytes, got %d with %d bytes", len(acquired), reserved)
+	}
+
+	// the unused part of a reservation is given back
+	acquired[0].commit(1)
+	for _, quota := range acquired[1:] {
+		quota.release()
+	}
+	if used, _ := userStore.GetDailyUsage(ctx, "bob"); used != 1 {
+		t.Errorf("expected 1 byte used after the refunds, got %d", used)
+	}
+}
+
+func TestAcquireQuotaExceeded(t *testing.T) {
+	userStore := newTestQuota(t, "6", "10")
+	ctx := context.Background()
+
+	quota, err := acquireQuota(ctx, userStore, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !quota.exceeded(7) || quota.exceeded(6) {
+		t.Errorf("expected only more than 6 bytes to exceed the quota, remaining %d", quota.remaining())
+	}
+	if message := quota.commit(6); message != "Daily quota: 4 B of 10 B remaining" {
+		t.Errorf("unexpected message %q", message)
+	}
+	quota.release()
+
+	quota, err = acquireQuota(ctx, userStore, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.remaining() != 4 {
+		t.Errorf("expected the rest of the day to be reserved, got %d", quota.remaining())
+	}
+	quota.commit(4)
+	quota.release()
+
+	_, err = acquireQuota(ctx, userStore, "bob")
+	if err == nil || err.Error() != "Limit REACHED: max file size is 6 B, 0 B of your daily 10 B remaining" {
+		t.Errorf("unexpected limit error %v", err)
+	}
+}
+
+func TestAcquireQuotaUnlimited(t *testing.T) {
+	userStore := newTestQuota(t, "0", "0")
+	ctx := context.Background()
+
+	quota, err := acquireQuota(ctx, userStore, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota.remaining() != -1 || quota.exceeded(1<<40) {
+		t.Errorf("expected an unlimited quota, remaining %d", quota.remaining())
+	}
+	if message := quota.commit(100); message != "Daily quota: unlimited" {
+		t.Errorf("unexpected message %q", message)
+	}
+	quota.release()
+
+	if used, _ := userStore.GetDailyUsage(ctx, "bob"); used != 100 {
+		t.Errorf("expected the usage to be kept, got %d", used)
+	}
+}
@@ -0,0 +1,472 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"trisend/internal/archive"
+	"trisend/internal/config"
+	"trisend/internal/db"
+	"trisend/internal/limiter"
+	"trisend/internal/notify"
+	"trisend/internal/seal"
+	"trisend/internal/storage"
+	"trisend/internal/tunnel"
+	"trisend/internal/types"
+	"trisend/internal/util"
+
+	"github.com/gliderlabs/ssh"
+)
+
+var (
+	errNotFound     = fmt.Errorf("Transfer not found or expired.")
+	errForbidden    = fmt.Errorf("You are not allowed to download this transfer.")
+	errPassword     = fmt.Errorf("This transfer is protected, pass its password with --password.")
+	errAttempts     = fmt.Errorf("Too many password attempts, try it later.")
+	errUploadFailed = fmt.Errorf("The sender failed to upload the file.")
+)
+
+// receiver hands transfers over to recipients, into their inbox and to
+// those connected over SSH instead of a browser.
+type receiver struct {
+	users     db.UserStore
+	registry  tunnel.Registry
+	transfers db.TransferStore
+	notifier  *notify.Notifier
+	// passwords limits the guesses on protected transfers, shared with the
+	// password form of the download page
+	passwords *limiter.Passwords
+}
+
+// deliver adds the transfer id to the inbox of its recipients that have
+// an account, the others need the link.
+func (rc *receiver) deliver(ctx context.Context, stderr io.Writer, id string, details *tunnel.StreamDetails) {
+	for _, recipient := range details.Recipients {
+		user, err := rc.findUser(ctx, recipient)
+		if err != nil {
+			slog.Error(err.Error())
+			continue
+		}
+		if user == nil {
+			fmt.Fprintf(stderr, "%s has no account yet, send them the link.\n", recipient)
+			continue
+		}
+
+		if err := rc.transfers.AddToInbox(ctx, user.ID, id, details.Expires); err != nil {
+			slog.Error(err.Error())
+			continue
+		}
+		rc.notifier.Delivered(user.ID, *details)
+		fmt.Fprintf(stderr, "Sent to the inbox of %s\n", user.Username)
+	}
+}
+
+// findUser looks a recipient given with --to up, nil when unknown.
+func (rc *receiver) findUser(ctx context.Context, recipient string) (*types.Session, error) {
+	if strings.Contains(recipient, "@") {
+		return rc.users.FindByEmail(ctx, recipient)
+	}
+
+	return rc.users.FindByUsername(ctx, recipient)
+}
+
+// handleGet writes a transfer to the stdout of a `get` session.
+func (rc *receiver) handleGet(session ssh.Session, stderr io.Writer, userID string, args []string) {
+	opts, err := parseGetArgs(args)
+	if errors.Is(err, errHelp) {
+		fmt.Fprint(stderr, usage())
+		session.Exit(0)
+		return
+	} else if err != nil {
+		fmt.Fprintf(stderr, "trisend: %v\nRun 'ssh trisend help' for usage.\n", err)
+		session.Exit(1)
+		return
+	}
+
+	user, err := rc.users.GetUser(session.Context(), userID)
+	if err != nil || user == nil {
+		fmt.Fprintln(stderr, authError)
+		session.Exit(1)
+		return
+	}
+
+	details, err := rc.authorize(session.Context(), opts.ID, user, opts.Password)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		session.Exit(1)
+		return
+	}
+
+	// the file goes to the raw channel, a terminal would mangle it
+	fmt.Fprintf(stderr, "Receiving %s\n", details.Filename)
+	checksum := sha256.New()
+	stdout := &countingWriter{w: io.MultiWriter(session, checksum)}
+	if err := rc.receive(session.Context(), details, user, stdout); err != nil {
+		if errors.Is(err, errNotFound) || errors.Is(err, errUploadFailed) {
+			fmt.Fprintln(stderr, err)
+		} else {
+			slog.Error(err.Error())
+			fmt.Fprintln(stderr, defaultError)
+		}
+		session.Exit(1)
+		return
+	}
+
+	fmt.Fprintf(stderr, "Received %s (%s)\n", details.Filename, util.FormatBytes(stdout.written))
+	received := hex.EncodeToString(checksum.Sum(nil))
+	fmt.Fprintf(stderr, "SHA-256: %s\n", received)
+	if details.Checksum != "" && details.Checksum != received {
+		fmt.Fprintf(stderr, "The file does not match the SHA-256 published by the sender, %s.\n", details.Checksum)
+		session.Exit(1)
+		return
+	}
+	if details.Sealed {
+		fmt.Fprintln(stderr, "The file is sealed, open it with seal -d -key <key from the link>.")
+	}
+}
+
+// authorize returns the details of the transfer if user can download it.
+func (rc *receiver) authorize(ctx context.Context, id string, user *types.Session, password string) (*tunnel.StreamDetails, error) {
+	details, ok := rc.registry.GetStreamDetails(id)
+	if !ok {
+		return nil, errNotFound
+	}
+
+	if details.RequiresAccount() && !details.CanDownload(user.Username, user.Email) {
+		return nil, errForbidden
+	}
+	if details.Visibility == tunnel.VisibilityPassword {
+		if password == "" {
+			return nil, errPassword
+		}
+
+		// guesses are counted per account, like per address in the browser
+		client := "user:" + user.ID
+		allowed, err := rc.passwords.Reserve(ctx, id, client)
+		if err != nil {
+			slog.Error(err.Error())
+			return nil, defaultError
+		}
+		if !allowed {
+			return nil, errAttempts
+		}
+		if !details.CheckPassword(password) {
+			return nil, errPassword
+		}
+		if err := rc.passwords.Succeeded(ctx, id, client); err != nil {
+			slog.Error(err.Error())
+		}
+	}
+
+	return details, nil
+}
+
+// receive writes the transfer to w. When the recipient is the first one,
+// the sender writes the upload straight into w instead of spooling it.
+// The checksum of what was received is set on details once it is known.
+func (rc *receiver) receive(ctx context.Context, details *tunnel.StreamDetails, user *types.Session, w io.Writer) error {
+	// the sender is connected to another instance
+	if !rc.registry.IsLocal(details.ID) {
+		res, err := fetchFromNode(ctx, details, user)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+
+		if _, err := io.Copy(w, res.Body); err != nil {
+			return err
+		}
+		// a header for spools, a trailer for relayed uploads
+		details.Checksum = res.Header.Get("X-Checksum-Sha256")
+		if checksum := res.Trailer.Get("X-Checksum-Sha256"); checksum != "" {
+			details.Checksum = checksum
+		}
+
+		return nil
+	}
+
+	relayed, err := rc.waitUpload(ctx, details, w)
+	if err != nil {
+		return err
+	} else if relayed != nil {
+		details.Checksum = relayed.Checksum
+		rc.recordDownload(details.ID, user)
+		return nil
+	}
+
+	object, spool, err := rc.openSpool(ctx, details.ID)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	if _, err := io.Copy(w, object); err != nil {
+		return err
+	}
+	details.Checksum = spool.Checksum
+	rc.completeDownload(details.ID, user)
+
+	return nil
+}
+
+// waitUpload makes sure the upload of the transfer is spooled, the first
+// recipient starts the upload and everyone else waits for it. A non nil w
+// lets the sender write the upload into it instead, the spool of the
+// relayed upload is returned when it did.
+func (rc *receiver) waitUpload(ctx context.Context, details *tunnel.StreamDetails, w io.Writer) (*tunnel.Spool, error) {
+	if _, ok := rc.registry.GetSpool(details.ID); ok {
+		return nil, nil
+	}
+
+	channel, err := rc.registry.WaitStream(ctx, details.ID)
+	if errors.Is(err, tunnel.ErrExpired) {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	} else if channel == nil {
+		return nil, nil
+	}
+
+	done := make(chan struct{})
+	failed := make(chan struct{})
+	stream := tunnel.Stream{Done: done, Error: failed, Format: archive.Zip}
+
+	var relayed *tunnel.Spool
+	if w != nil {
+		stream.Relay = func(spool *tunnel.Spool) io.Writer {
+			relayed = spool
+			return w
+		}
+	}
+
+	select {
+	case channel <- stream:
+	case <-time.After(time.Until(details.Expires)):
+		return nil, errNotFound
+	case <-ctx.Done():
+		rc.registry.ReturnStream(details.ID, channel)
+		return nil, ctx.Err()
+	}
+
+	select {
+	case <-done:
+		return relayed, nil
+	case <-failed:
+		return relayed, errUploadFailed
+	}
+}
+
+func (rc *receiver) openSpool(ctx context.Context, id string) (storage.Object, *tunnel.Spool, error) {
+	object, spool, err := rc.registry.OpenSpool(ctx, id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil, errNotFound
+	}
+
+	return object, spool, err
+}
+
+// completeDownload counts a finished download of a spool.
+func (rc *receiver) completeDownload(id string, user *types.Session) {
+	rc.registry.CompleteDownload(id)
+	rc.recordDownload(id, user)
+}
+
+// recordDownload adds a finished download to the history of the transfer.
+func (rc *receiver) recordDownload(id string, user *types.Session) {
+	download := types.Download{Username: user.Username, At: time.Now()}
+	if err := rc.transfers.AddDownload(context.Background(), id, download); err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	rc.notifier.Downloaded(id)
+}
+
+// fetchFromNode downloads a transfer from the instance its sender is
+// connected to on behalf of user, that instance counts the download.
+func fetchFromNode(ctx context.Context, details *tunnel.StreamDetails, user *types.Session) (*http.Response, error) {
+	if details.Node == "" {
+		return nil, errNotFound
+	}
+	if !config.IsKnownNode(details.Node) {
+		slog.Error("transfer of an unknown instance", "id", details.ID, "node", details.Node)
+		return nil, errNotFound
+	}
+
+	url := fmt.Sprintf("%s/download/direct/%s", strings.TrimSuffix(details.Node, "/"), details.ID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(tunnel.ForwardedHeader, config.NODE_URL)
+
+	// the recipient was authorized already, the token lets the other
+	// instance know who downloads and unlocks this transfer only
+	token, err := util.CreateNodeToken(details.ID, *user)
+	if err != nil {
+		return nil, err
+	}
+	req.AddCookie(&http.Cookie{Name: util.DOWNLOAD_COOKIE + details.ID, Value: token})
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, errNotFound
+	}
+
+	return res, nil
+}
+
+// prepareDownload gets a transfer ready for the random reads of an sftp
+// client. Transfers of other instances are fetched into a temp file first.
+func (rc *receiver) prepareDownload(ctx context.Context, details *tunnel.StreamDetails, user *types.Session) (*sftpDownload, error) {
+	if !rc.registry.IsLocal(details.ID) {
+		res, err := fetchFromNode(ctx, details, user)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+
+		// nothing keeps the key, the temp file is only read by this download
+		key, err := seal.NewKey()
+		if err != nil {
+			return nil, err
+		}
+		temp, err := createSealedTemp("", tempPattern+".temp", key)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(temp, res.Body); err != nil {
+			temp.Remove()
+			return nil, err
+		}
+		content, err := temp.Open()
+		if err != nil {
+			temp.Remove()
+			return nil, err
+		}
+
+		return &sftpDownload{
+			file:    content,
+			size:    content.Size(),
+			modTime: time.Now(),
+			close: func(bool) {
+				temp.Remove()
+			},
+		}, nil
+	}
+
+	if _, err := rc.waitUpload(ctx, details, nil); err != nil {
+		return nil, err
+	}
+
+	object, _, err := rc.openSpool(ctx, details.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sftpDownload{
+		file:    object,
+		size:    object.Size(),
+		modTime: object.ModTime(),
+		close: func(complete bool) {
+			if complete {
+				rc.completeDownload(details.ID, user)
+			}
+		},
+	}, nil
+}
+
+// sftpDownload is a transfer opened by an sftp client. Only downloads that
+// reached the end of the file are counted once it is closed.
+type sftpDownload struct {
+	mutex    sync.Mutex
+	file     io.ReadSeekCloser
+	size     int64
+	modTime  time.Time
+	complete bool
+	close    func(complete bool)
+}
+
+func (d *sftpDownload) ReadAt(p []byte, off int64) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, err := d.file.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(d.file, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	if off+int64(n) >= d.size {
+		d.complete = true
+	}
+
+	return n, err
+}
+
+func (d *sftpDownload) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	err := d.file.Close()
+	d.close(d.complete)
+
+	return err
+}
+
+// downloadInfo describes a transfer to sftp clients.
+type downloadInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i *downloadInfo) Name() string       { return i.name }
+func (i *downloadInfo) Size() int64        { return i.size }
+func (i *downloadInfo) Mode() os.FileMode  { return 0o444 }
+func (i *downloadInfo) ModTime() time.Time { return i.modTime }
+func (i *downloadInfo) IsDir() bool        { return false }
+func (i *downloadInfo) Sys() any           { return nil }
+
+// fileList answers sftp list and stat requests.
+type fileList []os.FileInfo
+
+func (l fileList) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.written += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"trisend/internal/config"
+	"trisend/internal/db"
+	"trisend/internal/limiter"
+	"trisend/internal/tunnel"
+	"trisend/internal/tunnel/tunneltest"
+	"trisend/internal/types"
+	"trisend/internal/util"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// downloadHistory records the downloads of the tests, the rest of the
+// store is not used.
+type downloadHistory struct {
+	db.TransferStore
+	mutex     sync.Mutex
+	downloads []types.Download
+}
+
+func (h *downloadHistory) AddDownload(ctx context.Context, id string, download types.Download) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.downloads = append(h.downloads, download)
+	return nil
+}
+
+func (h *downloadHistory) CreateTransfer(ctx context.Context, transfer types.Transfer) error {
+	return nil
+}
+
+func newTestReceiver(t *testing.T) (*receiver, *downloadHistory) {
+	history := &downloadHistory{}
+	passwords := limiter.NewPasswords(limiter.NewMemoryLimiter(5, time.Minute), limiter.NewMemoryLimiter(20, time.Minute))
+	return &receiver{registry: tunneltest.NewRegistry(t), transfers: history, passwords: passwords}, history
+}
+
+// helloChecksum is the hex SHA-256 of hello.
+const helloChecksum = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+func TestReceiveRelaysUpload(t *testing.T) {
+	rc, history := newTestReceiver(t)
+	recipient := &types.Session{Username: "bob"}
+
+	channel := make(chan tunnel.Stream)
+	rc.registry.SetStream("abc", channel, &tunnel.StreamDetails{
+		ID:         "abc",
+		Expires:    time.Now().Add(time.Minute),
+		Visibility: tunnel.VisibilityPrivate,
+		Recipients: []string{"bob"},
+	})
+
+	if _, err := rc.authorize(context.Background(), "abc", &types.Session{Username: "eve"}, ""); !errors.Is(err, errForbidden) {
+		t.Errorf("expected another user to be forbidden, got %v", err)
+	}
+	details, err := rc.authorize(context.Background(), "abc", recipient, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		stream, err := rc.registry.WaitRecipient(context.Background(), "abc")
+		if err != nil {
+			return
+		}
+		spool := &tunnel.Spool{Filename: "hello.txt"}
+		io.WriteString(stream.Relay(spool), "hello")
+		spool.Checksum = helloChecksum
+		close(stream.Done)
+	}()
+
+	var out bytes.Buffer
+	if err := rc.receive(context.Background(), details, recipient, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "hello" {
+		t.Errorf("expected hello, got %q", out.String())
+	}
+	if details.Checksum != helloChecksum {
+		t.Errorf("expected the checksum of the relayed upload, got %q", details.Checksum)
+	}
+	if len(history.downloads) != 1 || history.downloads[0].Username != "bob" {
+		t.Errorf("expected one download by bob, got %v", history.downloads)
+	}
+}
+
+func TestPrepareDownloadCountsCompleteReads(t *testing.T) {
+	rc, history := newTestReceiver(t)
+	recipient := &types.Session{Username: "bob"}
+
+	rc.registry.SetStream("abc", nil, &tunnel.StreamDetails{
+		ID:           "abc",
+		Expires:      time.Now().Add(time.Minute),
+		Visibility:   tunnel.VisibilityPublic,
+		MaxDownloads: 2,
+	})
+	err := rc.registry.StoreSpool(context.Background(), "abc", strings.NewReader("hello"), 5, &tunnel.Spool{Filename: "hello.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	details, _ := rc.registry.GetStreamDetails("abc")
+
+	// a read that stops short of the end is not a download
+	download, err := rc.prepareDownload(context.Background(), details, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	download.ReadAt(make([]byte, 2), 0)
+	download.Close()
+	if len(history.downloads) != 0 {
+		t.Errorf("expected no download for a partial read, got %v", history.downloads)
+	}
+
+	download, err = rc.prepareDownload(context.Background(), details, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 8)
+	n, err := download.ReadAt(p, 0)
+	if n != 5 || err != io.EOF || string(p[:n]) != "hello" {
+		t.Errorf("expected hello and io.EOF, got %q %v", p[:n], err)
+	}
+	download.Close()
+
+	if len(history.downloads) != 1 {
+		t.Errorf("expected one download, got %v", history.downloads)
+	}
+	if details, _ := rc.registry.GetStreamDetails("abc"); details.Downloads != 1 {
+		t.Errorf("expected the registry to count the download, got %d", details.Downloads)
+	}
+}
+
+func TestAuthorizeLimitsPasswordAttempts(t *testing.T) {
+	rc, _ := newTestReceiver(t)
+	ctx := context.Background()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.registry.SetStream("abc", nil, &tunnel.StreamDetails{
+		ID:           "abc",
+		Expires:      time.Now().Add(time.Minute),
+		Visibility:   tunnel.VisibilityPassword,
+		PasswordHash: hash,
+	})
+
+	mallory := &types.Session{ID: "mallory", Username: "mallory"}
+	for range 5 {
+		if _, err := rc.authorize(ctx, "abc", mallory, "wrong"); !errors.Is(err, errPassword) {
+			t.Fatalf("expected a wrong password, got %v", err)
+		}
+	}
+	if _, err := rc.authorize(ctx, "abc", mallory, "secret"); !errors.Is(err, errAttempts) {
+		t.Errorf("expected the account to be out of attempts, got %v", err)
+	}
+
+	if _, err := rc.authorize(ctx, "abc", &types.Session{ID: "bob", Username: "bob"}, "secret"); err != nil {
+		t.Errorf("expected another account to get the transfer, got %v", err)
+	}
+}
+
+func TestFetchFromNodeSendsTransferToken(t *testing.T) {
+	secret, nodes := config.JWT_SECRET, config.NODES
+	t.Cleanup(func() { config.JWT_SECRET, config.NODES = secret, nodes })
+	config.JWT_SECRET = "test"
+
+	requests := 0
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if _, err := r.Cookie("sess"); err == nil {
+			t.Error("expected no session to be sent to the other instance")
+		}
+		cookie, err := r.Cookie(util.DOWNLOAD_COOKIE + "abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := util.ParseToken(cookie.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		if claims["download"] != "abc" || claims["username"] != "bob" {
+			t.Errorf("expected a token for bob and abc only, got %v", claims)
+		}
+		if exp, _ := claims.GetExpirationTime(); exp == nil || time.Until(exp.Time) > time.Minute {
+			t.Errorf("expected a short lived token, got %v", exp)
+		}
+		io.WriteString(w, "hello")
+	}))
+	defer node.Close()
+
+	details := &tunnel.StreamDetails{ID: "abc", Node: node.URL, Expires: time.Now().Add(time.Hour)}
+	recipient := &types.Session{ID: "1", Username: "bob"}
+
+	config.NODES = nil
+	if _, err := fetchFromNode(context.Background(), details, recipient); !errors.Is(err, errNotFound) {
+		t.Errorf("expected an unknown instance to be refused, got %v", err)
+	}
+	if requests != 0 {
+		t.Fatalf("expected no request to an unknown instance, got %d", requests)
+	}
+
+	config.NODES = []string{node.URL}
+	res, err := fetchFromNode(context.Background(), details, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if body, _ := io.ReadAll(res.Body); string(body) != "hello" {
+		t.Errorf("expected hello, got %q", body)
+	}
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"trisend/internal/archive"
+)
+
+// maxPendingWrites bounds the memory used by writes that arrived ahead of
+// their offset, sftp clients only keep a few MB of requests in flight.
+const maxPendingWrites = 16 << 20
+
+// relay writes the entries of an SFTP upload into the archive sent to the
+// recipient as they arrive. Writing blocks while the recipient is slower
+// than the sender, which holds back the sftp requests of the sender.
+//
+// Archives are written one entry at a time, but sftp clients can open
+// several files at once. Opening or closing a file must never wait for
+// another one, pkg/sftp runs them on a single worker, so files opened
+// while an entry is written are staged on disk and queued once complete.
+type relay struct {
+	// mutex guards busy, queued and err
+	mutex sync.Mutex
+	// busy is set while an entry is written
+	busy bool
+	// queued holds the entries completed while the archive was busy,
+	// whoever holds the archive writes them before handing it back
+	queued  []queuedEntry
+	writer  archive.Writer
+	format  archive.Format
+	staging string
+	// key seals the files staged on disk
+	key []byte
+	err error
+}
+
+// queuedEntry is a complete entry waiting for the archive, temp is nil for
+// directories and symlinks.
+type queuedEntry struct {
+	header *archive.Header
+	temp   *sealedTemp
+}
+
+func newRelay(w io.Writer, format archive.Format, staging string, key []byte) (*relay, error) {
+	writer, err := archive.NewWriter(w, format)
+	if err != nil {
+		return nil, err
+	}
+
+	return &relay{
+		writer:  writer,
+		format:  format,
+		staging: staging,
+		key:     key,
+	}, nil
+}
+
+// writeEntry writes an entry without content, a directory or a symlink.
+func (r *relay) writeEntry(header *archive.Header) error {
+	return r.enqueue(queuedEntry{header: header})
+}
+
+type writerAtCloser interface {
+	io.WriterAt
+	io.Closer
+}
+
+// create starts a file entry. Zip entries are streamed right away when the
+// archive is free. Tar headers need the size of the file, so tar files are
+// staged on disk and relayed once they are complete, as are files opened
+// while another entry is written.
+func (r *relay) create(header *archive.Header) (writerAtCloser, error) {
+	if err := r.failed(); err != nil {
+		return nil, err
+	}
+
+	if r.format != archive.Zip || !r.acquire() {
+		temp, err := createSealedTemp(r.staging, "relay-*", r.key)
+		if err != nil {
+			return nil, err
+		}
+		file := &relayStagedFile{temp: temp, header: header, relay: r}
+		file.orderedWriter = newOrderedWriter(temp.Write)
+		return file, nil
+	}
+
+	reader, writer := io.Pipe()
+	file := &relayZipFile{
+		pipe:  writer,
+		done:  make(chan error, 1),
+		relay: r,
+	}
+	file.orderedWriter = newOrderedWriter(func(p []byte) (int, error) {
+		n, err := writer.Write(p)
+		return n, r.fail(err)
+	})
+
+	go func() {
+		err := r.writer.WriteEntry(header, reader)
+		reader.CloseWithError(err)
+		file.done <- err
+	}()
+
+	return file, nil
+}
+
+// acquire takes the archive when it is free, it never waits.
+func (r *relay) acquire() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.busy {
+		return false
+	}
+	r.busy = true
+
+	return true
+}
+
+// release hands the archive back, after writing the entries queued in the
+// meantime.
+func (r *relay) release() {
+	for {
+		r.mutex.Lock()
+		if len(r.queued) == 0 {
+			r.busy = false
+			r.mutex.Unlock()
+			return
+		}
+		entry := r.queued[0]
+		r.queued = r.queued[1:]
+		r.mutex.Unlock()
+
+		// the error is recorded by the relay, the file it belongs to has
+		// already been closed
+		r.write(entry)
+	}
+}
+
+// enqueue writes a complete entry, or queues it when another entry is
+// being written.
+func (r *relay) enqueue(entry queuedEntry) error {
+	r.mutex.Lock()
+	if r.busy {
+		r.queued = append(r.queued, entry)
+		r.mutex.Unlock()
+		return nil
+	}
+	r.busy = true
+	r.mutex.Unlock()
+	defer r.release()
+
+	return r.write(entry)
+}
+
+func (r *relay) write(entry queuedEntry) error {
+	if entry.temp == nil {
+		if err := r.failed(); err != nil {
+			return err
+		}
+		return r.fail(r.writer.WriteEntry(entry.header, nil))
+	}
+
+	defer entry.temp.Remove()
+	if err := r.failed(); err != nil {
+		return err
+	}
+
+	content, err := entry.temp.Open()
+	if err != nil {
+		return r.fail(err)
+	}
+	defer content.Close()
+
+	entry.header.Size = content.Size()
+	return r.fail(r.writer.WriteEntry(entry.header, content))
+}
+
+func (r *relay) close() error {
+	if err := r.failed(); err != nil {
+		return err
+	}
+
+	return r.fail(r.writer.Close())
+}
+
+// fail records the first error of the relay, the recipient has most likely
+// gone away and every following write fails with it.
+func (r *relay) fail(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+
+	return r.err
+}
+
+func (r *relay) failed() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.err
+}
+
+// orderedWriter orders the writes of a file before passing them to write,
+// the sftp server handles requests concurrently so they can arrive out of
+// order.
+type orderedWriter struct {
+	mutex   sync.Mutex
+	offset  int64
+	pending map[int64][]byte
+	size    int
+	write   func(p []byte) (int, error)
+}
+
+func newOrderedWriter(write func(p []byte) (int, error)) *orderedWriter {
+	return &orderedWriter{pending: map[int64][]byte{}, write: write}
+}
+
+func (w *orderedWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if off < w.offset {
+		return 0, errors.New("Rewriting an uploaded file is not supported")
+	}
+
+	if off > w.offset {
+		if w.size+len(p) > maxPendingWrites {
+			return 0, errors.New("Too many out of order writes")
+		}
+		w.pending[off] = append([]byte(nil), p...)
+		w.size += len(p)
+		return len(p), nil
+	}
+
+	if err := w.flush(p); err != nil {
+		return 0, err
+	}
+
+	for {
+		next, ok := w.pending[w.offset]
+		if !ok {
+			break
+		}
+		delete(w.pending, w.offset)
+		w.size -= len(next)
+
+		if err := w.flush(next); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *orderedWriter) flush(p []byte) error {
+	n, err := w.write(p)
+	w.offset += int64(n)
+
+	return err
+}
+
+// complete fails when parts of the file never arrived.
+func (w *orderedWriter) complete() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if len(w.pending) > 0 {
+		return errors.New("Upload ended with missing parts of the file")
+	}
+
+	return nil
+}
+
+// relayZipFile pipes the ordered writes of a file into its zip entry.
+type relayZipFile struct {
+	*orderedWriter
+	pipe   *io.PipeWriter
+	done   chan error
+	relay  *relay
+	closed bool
+}
+
+func (f *relayZipFile) Close() error {
+	f.mutex.Lock()
+	if f.closed {
+		f.mutex.Unlock()
+		return nil
+	}
+	f.closed = true
+	f.mutex.Unlock()
+	defer f.relay.release()
+
+	if err := f.complete(); err != nil {
+		f.pipe.CloseWithError(err)
+		<-f.done
+		return f.relay.fail(err)
+	}
+
+	f.pipe.Close()
+	return f.relay.fail(<-f.done)
+}
+
+// relayStagedFile stages a file on disk until it is complete, and hands it
+// to the relay on Close.
+type relayStagedFile struct {
+	*orderedWriter
+	temp   *sealedTemp
+	header *archive.Header
+	relay  *relay
+	closed bool
+}
+
+func (f *relayStagedFile) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	if err := f.complete(); err != nil {
+		f.temp.Remove()
+		return f.relay.fail(err)
+	}
+
+	return f.relay.enqueue(queuedEntry{header: f.header, temp: f.temp})
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"testing"
+	"trisend/internal/archive"
+	"trisend/internal/seal"
+)
+
+func testKey(t *testing.T) []byte {
+	key, err := seal.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestRelayOutOfOrderWrites(t *testing.T) {
+	for _, format := range []archive.Format{archive.Zip, archive.TarGz} {
+		buf := &bytes.Buffer{}
+		relay, err := newRelay(buf, format, t.TempDir(), testKey(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := relay.create(&archive.Header{Name: "notes.txt", Mode: 0o644})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, chunk := range []struct {
+			data string
+			off  int64
+		}{{"world", 6}, {"!", 11}, {"hello ", 0}} {
+			if _, err := file.WriteAt([]byte(chunk.data), chunk.off); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := file.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := relay.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := archive.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, content, err := reader.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(content)
+		if header.Name != "notes.txt" || string(data) != "hello world!" {
+			t.Errorf("%s: expected notes.txt with hello world!, got %s %q", format, header.Name, data)
+		}
+	}
+}
+
+func TestRelayMissingParts(t *testing.T) {
+	relay, err := newRelay(io.Discard, archive.Zip, t.TempDir(), testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := relay.create(&archive.Header{Name: "notes.txt", Mode: 0o644})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte("world"), 6)
+
+	if err := file.Close(); err == nil {
+		t.Errorf("expected an error for a file with missing parts")
+	}
+	if err := relay.close(); err == nil {
+		t.Errorf("expected the relay to fail after a broken file")
+	}
+}
+
+func TestRelayConcurrentFiles(t *testing.T) {
+	for _, format := range []archive.Format{archive.Zip, archive.TarGz} {
+		buf := &bytes.Buffer{}
+		relay, err := newRelay(buf, format, t.TempDir(), testKey(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// sftp clients can open several files at once, none of these may
+		// wait for another one to be closed
+		first, err := relay.create(&archive.Header{Name: "first.txt", Mode: 0o644})
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := relay.create(&archive.Header{Name: "second.txt", Mode: 0o644})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := relay.writeEntry(&archive.Header{Name: "docs", Mode: fs.ModeDir | 0o755}); err != nil {
+			t.Fatal(err)
+		}
+		first.WriteAt([]byte("one"), 0)
+		second.WriteAt([]byte("two"), 0)
+		if err := second.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := first.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := relay.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := archive.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries := map[string]string{}
+		for {
+			header, content, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := []byte{}
+			if content != nil {
+				data, _ = io.ReadAll(content)
+			}
+			entries[header.Name] = string(data)
+		}
+		if entries["first.txt"] != "one" || entries["second.txt"] != "two" || len(entries) != 3 {
+			t.Errorf("%s: expected first.txt, second.txt and docs, got %q", format, entries)
+		}
+	}
+}
@@ -1,15 +1,20 @@
 package server
 
 import (
+	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
-	"os"
+	"sync"
 	"time"
 	"trisend/internal/config"
 	"trisend/internal/db"
+	"trisend/internal/limiter"
+	"trisend/internal/notify"
+	"trisend/internal/tunnel"
 
 	"github.com/gliderlabs/ssh"
 	gossh "golang.org/x/crypto/ssh"
@@ -21,9 +26,14 @@ var banner string
 type Server struct {
 	httpServer *http.Server
 	sshServer  *ssh.Server
+	registry   tunnel.Registry
+	janitor    *janitor
+	// stopping is canceled when the server starts shutting down
+	stopping context.Context
+	stop     context.CancelFunc
 }
 
-func NewWebServer() *Server {
+func NewWebServer(registry tunnel.Registry) *Server {
 	httpServer := &http.Server{
 		Addr:         net.JoinHostPort("0.0.0.0", config.SERVER_PORT),
 		ReadTimeout:  10 * time.Second,
@@ -39,48 +49,115 @@ func NewWebServer() *Server {
 	}
 
 	sshServer := &ssh.Server{
-		Addr:    sshport,
-		Handler: handleSSH,
+		Addr: sshport,
+		// a PTY lets uploads render their progress on a single line
 		PtyCallback: func(ctx ssh.Context, pty ssh.Pty) bool {
-			return false
+			return true
 		},
 	}
 
+	stopping, stop := context.WithCancel(context.Background())
+
 	return &Server{
+		stopping:   stopping,
+		stop:       stop,
 		httpServer: httpServer,
 		sshServer:  sshServer,
+		registry:   registry,
+		janitor:    newJanitor(registry, config.JANITOR_INTERVAL),
 	}
 }
 
-func (server *Server) SetupConfig(router *http.ServeMux, privKey gossh.Signer, userStore db.UserStore) {
+func (server *Server) SetupConfig(router *http.ServeMux, privKey gossh.Signer, userStore db.UserStore, transferStore db.TransferStore, notifier *notify.Notifier, passwords *limiter.Passwords) {
 	configCallback := func(ctx ssh.Context) *gossh.ServerConfig {
 		conf := &gossh.ServerConfig{}
 		conf.AddHostKey(privKey)
 		return conf
 	}
 
+	receiver := &receiver{
+		users:     userStore,
+		registry:  server.registry,
+		transfers: transferStore,
+		notifier:  notifier,
+		passwords: passwords,
+	}
+
 	server.httpServer.Handler = router
 	server.sshServer.Banner = banner
+	server.sshServer.Handler = handleSSH(userStore, transferStore, server.registry, receiver, server.stopping)
 	server.sshServer.PublicKeyHandler = handlePublicKey(userStore)
 	server.sshServer.ServerConfigCallback = configCallback
 	server.sshServer.SubsystemHandlers = map[string]ssh.SubsystemHandler{
-		"sftp": handleSFTP(userStore),
+		"sftp": handleSFTP(userStore, transferStore, server.registry, receiver, server.stopping),
 	}
 }
 
-func (server *Server) ListenAndServe() {
+// ListenAndServe serves SSH and HTTP until ctx is done, then shuts down
+// gracefully within SHUTDOWN_TIMEOUT.
+func (server *Server) ListenAndServe(ctx context.Context) error {
+	go server.janitor.run(server.stopping)
+
+	errs := make(chan error, 2)
 	go func() {
 		slog.Info("SSH Server running")
-		if err := server.sshServer.ListenAndServe(); err != nil {
-			slog.Error(err.Error())
-			os.Exit(1)
-		}
+		errs <- server.sshServer.ListenAndServe()
+	}()
+	go func() {
+		slog.Info(fmt.Sprintf("HTTP Server running on PORT: %s", config.SERVER_PORT))
+		errs <- server.httpServer.ListenAndServe()
 	}()
 
-	slog.Info(fmt.Sprintf("HTTP Server running on PORT: %s", config.SERVER_PORT))
-	if err := server.httpServer.ListenAndServe(); err != nil {
-		slog.Error(err.Error())
-		os.Exit(1)
+	select {
+	case err := <-errs:
+		server.stop()
+		server.sshServer.Close()
+		server.httpServer.Close()
+		return err
+	case <-ctx.Done():
 	}
 
+	slog.Info("Shutting down, waiting for active transfers")
+	ctx, cancel := context.WithTimeout(context.Background(), config.SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	return server.Shutdown(ctx)
+}
+
+// Shutdown stops accepting SSH sessions and HTTP requests and sends the
+// senders still waiting for a recipient away. Active transfers are given
+// until ctx is done to finish, the remaining connections are closed then.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.stop()
+
+	var wg sync.WaitGroup
+	var sshErr, httpErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sshErr = server.sshServer.Shutdown(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		httpErr = server.httpServer.Shutdown(ctx)
+	}()
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		slog.Warn("Shutdown timed out, closing active transfers")
+		sshErr = server.sshServer.Close()
+		httpErr = server.httpServer.Close()
+	}
+
+	return errors.Join(sshErr, httpErr)
+}
+
+// Stopping is closed once the server starts shutting down.
+func (server *Server) Stopping() <-chan struct{} {
+	return server.stopping.Done()
+}
+
+// JanitorStats returns what the janitor cleaned up so far.
+func (server *Server) JanitorStats() JanitorStats {
+	return server.janitor.stats()
 }
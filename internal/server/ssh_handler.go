@@ -1,44 +1,80 @@
 package server
 
 import (
-	"archive/zip"
 	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"log/slog"
+	"mime"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
+	"trisend/internal/archive"
 	"trisend/internal/config"
 	"trisend/internal/db"
+	"trisend/internal/seal"
 	"trisend/internal/tunnel"
+	"trisend/internal/types"
 	"trisend/internal/util"
 
 	"github.com/gliderlabs/ssh"
 	"github.com/pkg/sftp"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
 	stream_details = "user"
-	limit          = 5295309 // 5.05MB
-	timeout        = time.Minute * 10
 )
 
 var (
-	maxLimitError   = fmt.Errorf("Limit REACHED: 5.04 MB")
-	defaultError    = fmt.Errorf("An error has occurred, try it later.")
-	authError       = fmt.Errorf("No Account found with SSH key. Create a new account.")
-	expirationError = fmt.Errorf("15 minutes has been expired")
+	defaultError = fmt.Errorf("An error has occurred, try it later.")
+	authError    = fmt.Errorf("No Account found with SSH key. Create a new account.")
+	// errShuttingDown is sent to senders waiting for a recipient when the
+	// server shuts down
+	errShuttingDown = fmt.Errorf("The server is restarting, upload again in a moment.")
+	errRevoked      = fmt.Errorf("The link was revoked.")
 )
 
+func expirationError(expires time.Duration) error {
+	return fmt.Errorf("Link expired after %s without a download", util.FormatDuration(expires))
+}
+
+func checksumError(expected, received string) error {
+	return fmt.Errorf("Checksum mismatch, expected %s but received %s. The transfer was aborted.", expected, received)
+}
+
+// waitContext is done when the session ends or when the server shuts down,
+// in which case its cause is errShuttingDown.
+func waitContext(session context.Context, stopping context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(session)
+	stop := context.AfterFunc(stopping, func() {
+		cancel(errShuttingDown)
+	})
+
+	return ctx, func() {
+		stop()
+		cancel(context.Canceled)
+	}
+}
+
 func downloadURL(ID string) string {
 	return fmt.Sprintf("LINK: %s/download/%s", config.HOST, ID)
 }
 
+// sealedHint reminds senders of sealed uploads that the link is useless
+// without the key.
+const sealedHint = "Append the KEY printed by seal to the LINK, recipients need it to decrypt the file."
+
 func handlePublicKey(userStore db.UserStore) ssh.PublicKeyHandler {
 	return func(ctx ssh.Context, key ssh.PublicKey) bool {
 		shaHash := sha256.Sum256(key.Marshal())
@@ -50,6 +86,7 @@ func handlePublicKey(userStore db.UserStore) ssh.PublicKeyHandler {
 		}
 
 		streamDetails := &tunnel.StreamDetails{
+			UserID:   user.ID,
 			Username: user.Username,
 			Pfp:      user.Pfp,
 		}
@@ -59,100 +96,248 @@ func handlePublicKey(userStore db.UserStore) ssh.PublicKeyHandler {
 	}
 }
 
-func handleSSH(session ssh.Session) {
-	errChanClosed := true
+func handleSSH(userStore db.UserStore, transfers db.TransferStore, registry tunnel.Registry, receiver *receiver, stopping context.Context) ssh.Handler {
+	return func(session ssh.Session) {
+		value := session.Context().Value(stream_details)
+		if value == nil {
+			fmt.Fprintln(session.Stderr(), authError)
+			session.Exit(1)
+			return
+		}
+		// the details of the connection are shared by its sessions, each
+		// upload fills its own copy
+		details := *value.(*tunnel.StreamDetails)
+		streamDetails := &details
 
-	value := session.Context().Value(stream_details)
-	if value == nil {
-		fmt.Fprintln(session.Stderr(), authError)
-		session.Exit(1)
-		return
-	}
-	streamDetails := value.(*tunnel.StreamDetails)
+		// a terminal in raw mode needs carriage returns to start new lines
+		_, _, isPty := session.Pty()
+		var stdout io.Writer = session
+		var stderr io.Writer = session.Stderr()
+		if isPty {
+			stdout = &crlfWriter{w: stdout}
+			stderr = &crlfWriter{w: stderr}
+		}
 
-	id := util.GetRandomID(10)
-	filename := filepath.Base(session.RawCommand())
-	noExtName := filename[:len(filename)-len(filepath.Ext(filename))]
-	if noExtName == "" || filename == "" {
-		fmt.Fprintln(session.Stderr(), "ssh trisend <filename> < <filepath>")
-		session.Exit(1)
-		return
-	}
+		if command := session.Command(); len(command) > 0 && command[0] == "get" {
+			receiver.handleGet(session, stderr, streamDetails.UserID, command[1:])
+			return
+		}
 
-	temp, err := os.CreateTemp("", "trisend-*.temp")
-	if err != nil {
-		slog.Error(err.Error())
-		fmt.Fprintln(session, defaultError)
-		session.Exit(1)
-		return
-	}
-	defer temp.Close()
+		opts, err := parseUploadArgs(session.Command())
+		if errors.Is(err, errHelp) {
+			fmt.Fprint(stderr, usage())
+			session.Exit(0)
+			return
+		} else if err != nil {
+			fmt.Fprintf(stderr, "trisend: %v\nRun 'ssh trisend help' for usage.\n", err)
+			session.Exit(1)
+			return
+		}
+		progress := newProgress(stderr, isPty, opts.Size)
 
-	streamDetails.Filename = noExtName
-	streamDetails.Expires = time.Now().Add(timeout)
-	tunnel.SetStream(id, make(chan tunnel.Stream), streamDetails)
+		id := util.GetRandomID(10)
 
-	fmt.Fprintln(session, downloadURL(id))
+		quota, err := acquireQuota(session.Context(), userStore, streamDetails.UserID)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			session.Exit(1)
+			return
+		}
+		defer quota.release()
 
-	channel, _ := tunnel.GetStream(id)
-	defer close(channel)
+		// the upload only touches the disk sealed with a key kept in memory
+		streamDetails.SpoolKey, err = seal.NewKey()
+		if err != nil {
+			slog.Error(err.Error())
+			fmt.Fprintln(stdout, defaultError)
+			session.Exit(1)
+			return
+		}
+		temp, err := createSealedTemp("", tempPattern+".temp", streamDetails.SpoolKey)
+		if err != nil {
+			slog.Error(err.Error())
+			fmt.Fprintln(stdout, defaultError)
+			session.Exit(1)
+			return
+		}
+		defer temp.Remove()
 
-	var stream tunnel.Stream
-	select {
-	case stream = <-channel:
-	case <-time.After(timeout):
-		fmt.Fprintln(session.Stderr(), expirationError)
-		tunnel.DeleteStream(id)
-		session.Exit(1)
-		return
-	}
+		streamDetails.Filename = opts.DisplayName()
+		if opts.Format != "" {
+			streamDetails.Filename = trimExt(opts.DisplayName())
+		}
+		streamDetails.Message = opts.Message
+		streamDetails.Sealed = opts.Sealed
+		streamDetails.Expires = time.Now().Add(opts.Expires)
+		streamDetails.MaxDownloads = opts.MaxDownloads
+		streamDetails.Recipients = opts.To
+		streamDetails.Visibility = tunnel.VisibilityPrivate
+		if opts.Public {
+			streamDetails.Visibility = tunnel.VisibilityPublic
+		}
+		if opts.Password != "" {
+			hash, err := bcrypt.GenerateFromPassword([]byte(opts.Password), bcrypt.DefaultCost)
+			if err != nil {
+				slog.Error(err.Error())
+				fmt.Fprintln(stderr, defaultError)
+				session.Exit(1)
+				return
+			}
+			streamDetails.Visibility = tunnel.VisibilityPassword
+			streamDetails.PasswordHash = hash
+		}
+
+		streamDetails.Size = opts.Size
+		progress.publish(registry, id)
+		recordTransfer(session.Context(), transfers, id, streamDetails)
+
+		var stream *tunnel.Stream
+		if config.STORE_FORWARD {
+			registry.SetStream(id, nil, streamDetails)
+			receiver.deliver(session.Context(), stderr, id, streamDetails)
+		} else {
+			channel := make(chan tunnel.Stream)
+			registry.SetStream(id, channel, streamDetails)
+			receiver.deliver(session.Context(), stderr, id, streamDetails)
+
+			fmt.Fprintln(stdout, downloadURL(id))
+			if opts.Sealed {
+				fmt.Fprintln(stderr, sealedHint)
+			}
+
+			ctx, cancel := waitContext(session.Context(), stopping)
+			defer cancel()
 
-	defer func() {
-		close(stream.Done)
-		if !errChanClosed {
-			close(stream.Error)
+			recipient, err := progress.waitRecipient(func() (*tunnel.Stream, error) {
+				return registry.WaitRecipient(ctx, id)
+			}, opts.Expires)
+			if err != nil {
+				registry.DeleteStream(id)
+				if errors.Is(context.Cause(ctx), errShuttingDown) {
+					fmt.Fprintln(stderr, errShuttingDown)
+					session.Exit(1)
+					return
+				}
+				// the sender went away
+				if !errors.Is(err, tunnel.ErrExpired) {
+					return
+				}
+				if time.Now().Before(streamDetails.Expires) {
+					fmt.Fprintln(stderr, errRevoked)
+				} else {
+					fmt.Fprintln(stderr, expirationError(opts.Expires))
+				}
+				session.Exit(1)
+				return
+			}
+			stream = recipient
+			registry.SetStatus(id, tunnel.StatusUploading)
 		}
-	}()
 
-	limitReader := io.LimitReader(session, limit)
+		fail := func(err error) {
+			if stream != nil {
+				close(stream.Error)
+			}
+			registry.DeleteStream(id)
+			fmt.Fprintln(stderr, err)
+			session.Exit(1)
+		}
 
-	amount, err := io.Copy(temp, limitReader)
-	if err != nil {
-		close(stream.Error)
-		fmt.Fprintln(session.Stderr(), maxLimitError)
-		session.Exit(1)
-		return
-	}
-	if amount == limit {
-		close(stream.Error)
-		fmt.Fprintln(session, maxLimitError)
-		session.Exit(1)
-		return
-	}
+		var reader io.Reader = session
+		if remaining := quota.remaining(); remaining >= 0 {
+			reader = io.LimitReader(session, remaining+1)
+		}
+		reader = progress.Reader(reader)
 
-	_, err = temp.Seek(0, 0)
-	if err != nil {
-		slog.Error(err.Error())
-		os.Exit(1)
-	}
+		amount, err := io.Copy(temp, reader)
+		if err != nil {
+			slog.Error(err.Error())
+			fail(defaultError)
+			return
+		}
+		progress.done()
+		if quota.exceeded(amount) {
+			fail(quota.limitError())
+			return
+		}
+		if opts.SHA256 != "" && temp.Checksum() != opts.SHA256 {
+			fail(checksumError(opts.SHA256, temp.Checksum()))
+			return
+		}
+		content, err := temp.Open()
+		if err != nil {
+			slog.Error(err.Error())
+			fail(defaultError)
+			return
+		}
+		defer content.Close()
 
-	stream.Writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", noExtName))
-	zipWriter := zip.NewWriter(stream.Writer)
-	fileWriter, err := zipWriter.Create(filename)
-	if err != nil {
-		slog.Error(err.Error())
-		os.Exit(1)
-	}
+		spool := &tunnel.Spool{
+			Filename: opts.DisplayName(),
+			Checksum: temp.Checksum(),
+		}
+		// the content type of the plaintext is only known to the browser
+		if opts.Sealed {
+			spool.Filename += ".sealed"
+			spool.ContentType = "application/octet-stream"
+		}
+
+		if opts.Format != "" {
+			wrapped, err := buildArchive(opts.Format, streamDetails.SpoolKey, func(w archive.Writer) error {
+				header := &archive.Header{
+					Name:    opts.Filename,
+					Mode:    0o644,
+					ModTime: time.Now(),
+					Size:    amount,
+				}
+				return w.WriteEntry(header, content)
+			})
+			if err != nil {
+				slog.Error(err.Error())
+				fail(defaultError)
+				return
+			}
+			defer wrapped.Remove()
+
+			archived, err := wrapped.Open()
+			if err != nil {
+				slog.Error(err.Error())
+				fail(defaultError)
+				return
+			}
+			defer archived.Close()
+
+			content = archived
+			spool = &tunnel.Spool{
+				Filename:    trimExt(opts.DisplayName()) + opts.Format.Ext(),
+				ContentType: opts.Format.ContentType(),
+				Format:      opts.Format,
+				Checksum:    wrapped.Checksum(),
+			}
+		}
 
-	errChanClosed = false
-	io.Copy(fileWriter, temp)
-	zipWriter.Close()
+		if err := storeSpool(session.Context(), registry, id, content, spool); err != nil {
+			slog.Error(err.Error())
+			fail(defaultError)
+			return
+		}
+		recordSize(session.Context(), transfers, id, amount)
+
+		fmt.Fprintln(stderr, quota.commit(amount))
+		fmt.Fprintf(stderr, "SHA-256: %s\n", spool.Checksum)
+		if stream != nil {
+			close(stream.Done)
+			return
+		}
+		fmt.Fprintln(stdout, downloadURL(id))
+		if opts.Sealed {
+			fmt.Fprintln(stderr, sealedHint)
+		}
+	}
 }
 
-func handleSFTP(userStore db.UserStore) ssh.SubsystemHandler {
+func handleSFTP(userStore db.UserStore, transfers db.TransferStore, registry tunnel.Registry, receiver *receiver, stopping context.Context) ssh.SubsystemHandler {
 	return func(session ssh.Session) {
-		errChanClosed := true
-
 		shaHash := sha256.Sum256(session.PublicKey().Marshal())
 		fingerprint := base64.RawStdEncoding.EncodeToString(shaHash[:])
 
@@ -163,182 +348,777 @@ func handleSFTP(userStore db.UserStore) ssh.SubsystemHandler {
 			return
 		}
 
-		temp, err := os.CreateTemp("", "trisend-*.temp")
+		quota, err := acquireQuota(session.Context(), userStore, user.ID)
+		if err != nil {
+			fmt.Fprintln(session.Stderr(), err)
+			session.Exit(1)
+			return
+		}
+		defer quota.release()
+
+		staging, err := os.MkdirTemp("", tempPattern)
 		if err != nil {
 			slog.Error(err.Error())
-			os.Exit(1)
+			fmt.Fprintln(session.Stderr(), defaultError)
+			session.Exit(1)
+			return
 		}
-		defer temp.Close()
+		defer os.RemoveAll(staging)
 
 		streamDetails := new(tunnel.StreamDetails)
+		streamDetails.UserID = user.ID
 		streamDetails.Username = user.Username
 		streamDetails.Pfp = user.Pfp
+		streamDetails.Expires = time.Now().Add(config.DEFAULT_EXPIRY)
+		streamDetails.SpoolKey, err = seal.NewKey()
+		if err != nil {
+			slog.Error(err.Error())
+			fmt.Fprintln(session.Stderr(), defaultError)
+			session.Exit(1)
+			return
+		}
 
-		expiration := time.Now().Add(timeout)
-		streamDetails.Expires = expiration
+		ctx, cancel := waitContext(session.Context(), stopping)
+		defer cancel()
 
 		handler := newSFTPHandler(
+			ctx,
 			session.Stderr(),
-			temp,
+			staging,
+			quota,
+			newProgress(session.Stderr(), false, 0),
+			registry,
+			transfers,
 			streamDetails,
 		)
-		defer func() {
-			if time.Now().After(expiration) {
-				return
-			}
-			close(handler.stream.Done)
-			if !errChanClosed {
+		handler.receiver = receiver
+		handler.recipient = user
+		defer handler.closeDownloads()
+
+		fail := func(err error) {
+			if handler.stream != nil {
 				close(handler.stream.Error)
 			}
-		}()
+			registry.DeleteStream(handler.id)
+			fmt.Fprintln(session.Stderr(), err)
+			session.Exit(1)
+		}
 
 		srv := sftp.NewRequestServer(session, handler.Build())
 		handler.server = srv
 
 		if err := srv.Serve(); err != nil && err != io.EOF {
-			if time.Now().After(expiration) {
-				fmt.Fprintln(session.Stderr(), expirationError)
+			if handler.expired {
 				session.Exit(1)
 				return
 			}
 
-			close(handler.stream.Error)
-			if errors.Is(err, maxLimitError) {
-				fmt.Fprintln(session.Stderr(), maxLimitError)
-				session.Exit(1)
+			if handler.limitErr != nil {
+				fail(handler.limitErr)
 				return
 			}
 
 			slog.Error(err.Error())
-			fmt.Fprintln(session, defaultError)
-			session.Exit(1)
+			fail(defaultError)
+			return
+		}
+
+		// nothing was uploaded
+		if handler.id == "" || handler.expired {
 			return
 		}
+		handler.progress.done()
+
+		if handler.relay != nil {
+			if err := handler.relay.close(); err != nil {
+				slog.Error(err.Error())
+				fail(defaultError)
+				return
+			}
+
+			// the recipient reads it once Done is closed, to verify what it
+			// received
+			checksum := hex.EncodeToString(handler.relayChecksum.Sum(nil))
+			handler.relaySpool.Checksum = checksum
+			registry.SetChecksum(handler.id, checksum)
+
+			fmt.Fprintln(session.Stderr(), quota.commit(handler.totalSize))
+			fmt.Fprintf(session.Stderr(), "SHA-256: %s\n", checksum)
+			recordSize(session.Context(), transfers, handler.id, handler.totalSize)
+			registry.SetStatus(handler.id, tunnel.StatusCompleted)
+			close(handler.stream.Done)
+			registry.DeleteStream(handler.id)
+			return
+		}
+
+		var temp *sealedTemp
+		var spool *tunnel.Spool
+
+		// a single file is sent as is, an archive is only needed for several files
+		if entry, ok := handler.singleFile(); ok {
+			temp = entry.file
+			spool = &tunnel.Spool{
+				Filename: path.Base(entry.header.Name),
+				Checksum: temp.Checksum(),
+			}
+		} else {
+			temp, err = buildArchive(archive.Zip, streamDetails.SpoolKey, handler.writeEntries)
+			if err != nil {
+				slog.Error(err.Error())
+				fail(defaultError)
+				return
+			}
+			defer temp.Remove()
+			spool = &tunnel.Spool{
+				Filename:    trimExt(streamDetails.Filename) + archive.Zip.Ext(),
+				ContentType: archive.Zip.ContentType(),
+				Format:      archive.Zip,
+				Checksum:    temp.Checksum(),
+			}
+		}
 
-		err = handler.zipWriter.Close()
+		content, err := temp.Open()
 		if err != nil {
-			close(handler.stream.Error)
 			slog.Error(err.Error())
-			fmt.Fprintln(session.Stderr(), defaultError)
-			session.Exit(1)
+			fail(defaultError)
 			return
 		}
+		defer content.Close()
 
-		_, err = handler.tempFile.Seek(0, 0)
+		err = storeSpool(session.Context(), registry, handler.id, content, spool)
 		if err != nil {
-			close(handler.stream.Error)
 			slog.Error(err.Error())
-			fmt.Fprintln(session.Stderr(), defaultError)
-			session.Exit(1)
+			fail(defaultError)
 			return
 		}
+		recordSize(session.Context(), transfers, handler.id, handler.totalSize)
+
+		fmt.Fprintln(session.Stderr(), quota.commit(handler.totalSize))
+		fmt.Fprintf(session.Stderr(), "SHA-256: %s\n", spool.Checksum)
+		if handler.stream != nil {
+			close(handler.stream.Done)
+			return
+		}
+		fmt.Fprintln(session.Stderr(), downloadURL(handler.id))
+	}
+}
+
+// recordTransfer adds a new transfer to the history of its sender, the
+// upload goes on without it when the history can not be written.
+func recordTransfer(ctx context.Context, transfers db.TransferStore, id string, details *tunnel.StreamDetails) {
+	err := transfers.CreateTransfer(ctx, types.Transfer{
+		ID:       id,
+		UserID:   details.UserID,
+		Filename: details.Filename,
+		Size:     details.Size,
+		Created:  time.Now(),
+		Expires:  details.Expires,
+	})
+	if err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+// recordSize completes the history of a transfer once its upload is done.
+func recordSize(ctx context.Context, transfers db.TransferStore, id string, size int64) {
+	if err := transfers.SetTransferSize(ctx, id, size); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+// storeSpool moves a finished upload from its temp file into storage.
+func storeSpool(ctx context.Context, registry tunnel.Registry, id string, content io.ReadSeeker, spool *tunnel.Spool) error {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if spool.ContentType == "" {
+		head := make([]byte, 512)
+		n, err := io.ReadFull(content, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		spool.ContentType = detectContentType(spool.Filename, head[:n])
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	return registry.StoreSpool(ctx, id, content, size, spool)
+}
 
-		errChanClosed = false
-		handler.stream.Writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", streamDetails.Filename))
+// detectContentType prefers the type registered for the file extension
+// and sniffs the content otherwise.
+func detectContentType(filename string, head []byte) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(filename)); contentType != "" {
+		return contentType
+	}
 
-		io.Copy(handler.stream.Writer, handler.tempFile)
+	return http.DetectContentType(head)
+}
+
+// buildArchive writes an archive of the given format into a new temp file
+// sealed with key, the entries are added by write.
+func buildArchive(format archive.Format, key []byte, write func(archive.Writer) error) (*sealedTemp, error) {
+	temp, err := createSealedTemp("", tempPattern+".temp", key)
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := archive.NewWriter(temp, format)
+	if err == nil {
+		err = write(writer)
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
 	}
+	if err != nil {
+		temp.Remove()
+		return nil, err
+	}
+
+	return temp, nil
+}
+
+// stagedEntry is a file, directory or symlink received over SFTP. Files
+// are kept in the staging directory until the upload is finished.
+type stagedEntry struct {
+	header archive.Header
+	file   *sealedTemp
 }
 
 type sftpHandler struct {
 	sync.Once
-	stderr     io.Writer
-	zipWriter  *zip.Writer
-	totalSize  *int
-	tempFile   *os.File
-	server     *sftp.RequestServer
-	fileWriter io.Writer
+	mutex     sync.Mutex
+	ctx       context.Context
+	registry  tunnel.Registry
+	transfers db.TransferStore
+	id        string
+	expired   bool
+	limitErr  error
+	quota     *uploadQuota
+	progress  *progress
+	stderr    io.Writer
+	staging   string
+	root      string
+	entries   []*stagedEntry
+	relay     *relay
+	totalSize int64
+	server    *sftp.RequestServer
+	// relayChecksum hashes the archive written to the recipient, who gets
+	// it through relaySpool
+	relayChecksum hash.Hash
+	relaySpool    *tunnel.Spool
 
 	stream        *tunnel.Stream
 	streamDetails *tunnel.StreamDetails
+
+	// receiver serves sftp get to recipient, downloads holds the transfers
+	// prepared by a stat until they are opened
+	receiver  *receiver
+	recipient *types.Session
+	downloads map[string]*sftpDownload
+	fallback  sftp.Handlers
 }
 
-func newSFTPHandler(stderr io.ReadWriter, temp *os.File, streamDetails *tunnel.StreamDetails) *sftpHandler {
+func newSFTPHandler(ctx context.Context, stderr io.ReadWriter, staging string, quota *uploadQuota, progress *progress, registry tunnel.Registry, transfers db.TransferStore, streamDetails *tunnel.StreamDetails) *sftpHandler {
 	return &sftpHandler{
+		ctx:           ctx,
+		registry:      registry,
+		transfers:     transfers,
 		stderr:        stderr,
-		tempFile:      temp,
-		totalSize:     new(int),
+		staging:       staging,
+		quota:         quota,
+		progress:      progress,
 		streamDetails: streamDetails,
 	}
 }
 
 func (h *sftpHandler) Build() sftp.Handlers {
+	h.fallback = sftp.InMemHandler()
+
 	return sftp.Handlers{
-		FileGet:  sftp.InMemHandler().FileGet,
+		FileGet:  h,
 		FilePut:  h,
 		FileCmd:  h,
-		FileList: sftp.InMemHandler().FileList,
+		FileList: h,
+	}
+}
+
+// Fileread downloads the transfer named by the base of the path.
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	download, err := h.download(path.Base(r.Filepath), true)
+	if errors.Is(err, errNotFound) {
+		return h.fallback.FileGet.Fileread(r)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return download, nil
+}
+
+// Filelist answers the stat clients send before a get with the size of the
+// transfer, which has to be uploaded for it.
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	if r.Method != "Stat" && r.Method != "Lstat" {
+		return h.fallback.FileList.Filelist(r)
+	}
+
+	id := path.Base(r.Filepath)
+	download, err := h.download(id, false)
+	if errors.Is(err, errNotFound) {
+		return h.fallback.FileList.Filelist(r)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return fileList{&downloadInfo{name: id, size: download.size, modTime: download.modTime}}, nil
+}
+
+// download prepares the transfer id for the recipient, open hands it over
+// to the client instead of keeping it for the next request.
+func (h *sftpHandler) download(id string, open bool) (*sftpDownload, error) {
+	if h.receiver == nil {
+		return nil, errNotFound
+	}
+
+	h.mutex.Lock()
+	download, ok := h.downloads[id]
+	if ok && open {
+		delete(h.downloads, id)
+	}
+	h.mutex.Unlock()
+	if ok {
+		return download, nil
+	}
+
+	details, err := h.receiver.authorize(h.ctx, id, h.recipient, "")
+	if errors.Is(err, errNotFound) {
+		return nil, err
+	} else if err != nil {
+		// password protected transfers can only be received with ssh get
+		fmt.Fprintln(h.stderr, err)
+		return nil, sftp.ErrSshFxPermissionDenied
+	}
+
+	fmt.Fprintf(h.stderr, "Receiving %s\n", details.Filename)
+	download, err = h.receiver.prepareDownload(h.ctx, details, h.recipient)
+	if errors.Is(err, errNotFound) || errors.Is(err, errUploadFailed) {
+		fmt.Fprintln(h.stderr, err)
+		return nil, sftp.ErrSshFxNoSuchFile
+	} else if err != nil {
+		slog.Error(err.Error())
+		return nil, defaultError
+	}
+
+	if !open {
+		h.mutex.Lock()
+		if h.downloads == nil {
+			h.downloads = map[string]*sftpDownload{}
+		}
+		if previous, ok := h.downloads[id]; ok {
+			previous.Close()
+		}
+		h.downloads[id] = download
+		h.mutex.Unlock()
+	}
+
+	return download, nil
+}
+
+// closeDownloads releases the transfers that were prepared but never opened.
+func (h *sftpHandler) closeDownloads() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for id, download := range h.downloads {
+		download.Close()
+		delete(h.downloads, id)
 	}
 }
 
 func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
 	h.Do(func() {
-		ID := util.GetRandomID(10)
-		channel := make(chan tunnel.Stream)
-		defer close(channel)
+		h.id = util.GetRandomID(10)
+		h.progress.publish(h.registry, h.id)
 
 		if h.streamDetails.Filename == "" {
-			filename := filepath.Base(r.Filepath)
-			noExtName := filename[:len(filename)-len(filepath.Ext(filename))]
+			h.streamDetails.Filename = path.Base(r.Filepath)
+		}
 
-			h.streamDetails.Filename = noExtName
+		h.streamDetails.Expires = time.Now().Add(config.DEFAULT_EXPIRY)
+		recordTransfer(h.ctx, h.transfers, h.id, h.streamDetails)
+		if config.STORE_FORWARD {
+			h.registry.SetStream(h.id, nil, h.streamDetails)
+			return
 		}
 
-		h.streamDetails.Expires = time.Now().Add(timeout)
-		tunnel.SetStream(ID, channel, h.streamDetails)
+		channel := make(chan tunnel.Stream)
+		h.registry.SetStream(h.id, channel, h.streamDetails)
 
-		fmt.Fprintln(h.stderr, downloadURL(ID))
+		fmt.Fprintln(h.stderr, downloadURL(h.id))
 
-		select {
-		case stream := <-channel:
-			h.stream = &stream
-		case <-time.After(timeout):
-			fmt.Fprintln(h.stderr, expirationError)
-			tunnel.DeleteStream(ID)
+		stream, err := h.progress.waitRecipient(func() (*tunnel.Stream, error) {
+			return h.registry.WaitRecipient(h.ctx, h.id)
+		}, config.DEFAULT_EXPIRY)
+		if err != nil {
+			h.expired = true
+			if errors.Is(context.Cause(h.ctx), errShuttingDown) {
+				fmt.Fprintln(h.stderr, errShuttingDown)
+			} else if errors.Is(err, tunnel.ErrExpired) && time.Now().Before(h.streamDetails.Expires) {
+				fmt.Fprintln(h.stderr, errRevoked)
+			} else if errors.Is(err, tunnel.ErrExpired) {
+				fmt.Fprintln(h.stderr, expirationError(config.DEFAULT_EXPIRY))
+			}
+			h.registry.DeleteStream(h.id)
 			h.server.Close()
+			return
 		}
 
-		h.zipWriter = zip.NewWriter(h.tempFile)
+		h.stream = stream
+		h.registry.SetStatus(h.id, tunnel.StatusUploading)
+		if config.SFTP_RELAY && stream.Relay != nil {
+			h.startRelay()
+		}
 	})
 
-	fileWriter, err := h.zipWriter.Create(filepath.Base(r.Filepath))
+	if h.expired {
+		return nil, expirationError(config.DEFAULT_EXPIRY)
+	}
+
+	name, err := h.entryName(r.Filepath)
+	if err != nil {
+		fmt.Fprintln(h.stderr, err)
+		return nil, sftp.ErrSshFxPermissionDenied
+	}
+
+	header := archive.Header{
+		Name:    name,
+		Mode:    0o644,
+		ModTime: time.Now(),
+	}
+
+	if relay := h.currentRelay(); relay != nil {
+		file, err := relay.create(&header)
+		if err != nil {
+			return nil, err
+		}
+		return &relayedFile{writerAtCloser: file, handler: h}, nil
+	}
+
+	file, err := createSealedTemp(h.staging, "file-*", h.streamDetails.SpoolKey)
 	if err != nil {
 		slog.Error(err.Error())
 		return nil, defaultError
 	}
 
-	h.fileWriter = fileWriter
+	entry := h.addEntry(&stagedEntry{
+		header: header,
+		file:   file,
+	})
 
-	return h, nil
+	return &stagedFile{orderedWriter: newOrderedWriter(file.Write), entry: entry, handler: h}, nil
 }
 
 func (h *sftpHandler) Filecmd(r *sftp.Request) error {
-	// it executes only if it is a directoy, before transfer
-	if r.Method == "Mkdir" {
+	switch r.Method {
+	// it executes for every directoy of a recursive upload, before its content
+	case "Mkdir":
+		name, err := h.entryName(r.Filepath)
+		if err != nil {
+			fmt.Fprintln(h.stderr, err)
+			return sftp.ErrSshFxPermissionDenied
+		}
+
 		if h.streamDetails.Filename == "" {
-			h.streamDetails.Filename = filepath.Base(r.Filepath)
+			h.streamDetails.Filename = path.Base(name)
+		}
+		entry := h.addEntry(&stagedEntry{
+			header: archive.Header{
+				Name:    name,
+				Mode:    fs.ModeDir | 0o755,
+				ModTime: time.Now(),
+			},
+		})
+		return h.relayEntry(entry)
+	case "Symlink":
+		// Target is the path of the link and Filepath what it points to
+		name, err := h.entryName(r.Target)
+		if err == nil {
+			err = checkLinkname(name, r.Filepath)
+		}
+		if err != nil {
+			fmt.Fprintln(h.stderr, err)
+			return sftp.ErrSshFxPermissionDenied
+		}
+
+		entry := h.addEntry(&stagedEntry{
+			header: archive.Header{
+				Name:     name,
+				Mode:     fs.ModeSymlink | 0o777,
+				ModTime:  time.Now(),
+				Linkname: r.Filepath,
+			},
+		})
+		return h.relayEntry(entry)
+	// it executes after transfer, scp -p and sftp put -p send the original
+	// permissions and times
+	case "Setstat":
+		if name, err := h.entryName(r.Filepath); err == nil {
+			h.setAttributes(name, r)
 		}
 		return nil
 	}
-	// it executes after transfer
-	if r.Method == "Setstat" {
+	return sftp.ErrSshFxOpUnsupported
+}
+
+// entryName returns the path of an upload inside the archive. Paths are
+// relative to the directory of the first upload, anything outside of it
+// is rejected.
+func (h *sftpHandler) entryName(requested string) (string, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	requested = path.Clean("/" + requested)
+	if h.root == "" {
+		h.root = path.Dir(requested)
+	}
+
+	name, ok := strings.CutPrefix(requested, strings.TrimSuffix(h.root, "/")+"/")
+	if !ok || name == "" {
+		return "", fmt.Errorf("Rejected %s, uploads must stay inside %s", requested, h.root)
+	}
+
+	return name, nil
+}
+
+// checkLinkname rejects symlinks pointing outside of the archive, they
+// would let an extracted archive write anywhere on the recipient disk.
+func checkLinkname(name, linkname string) error {
+	target := path.Join(path.Dir(name), linkname)
+	if path.IsAbs(linkname) || target == ".." || strings.HasPrefix(target, "../") {
+		return fmt.Errorf("Rejected symlink %s, it points outside of the upload", name)
+	}
+
+	return nil
+}
+
+// addEntry stages an entry, uploading a path twice replaces the previous
+// entry.
+func (h *sftpHandler) addEntry(entry *stagedEntry) *stagedEntry {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i, existing := range h.entries {
+		if existing.header.Name != entry.header.Name {
+			continue
+		}
+		if existing.file != nil {
+			existing.file.Remove()
+		}
+		h.entries[i] = entry
+		return entry
+	}
+
+	h.entries = append(h.entries, entry)
+	return entry
+}
+
+func (h *sftpHandler) setAttributes(name string, r *sftp.Request) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+	for _, entry := range h.entries {
+		if entry.header.Name != name {
+			continue
+		}
+		if flags.Permissions {
+			entry.header.Mode = entry.header.Mode.Type() | attrs.FileMode().Perm()
+		}
+		if flags.Acmodtime {
+			entry.header.ModTime = time.Unix(int64(attrs.Mtime), 0)
+		}
+	}
+}
+
+// startRelay sends the upload straight to the recipient, the directories
+// created while waiting for the recipient are relayed first.
+func (h *sftpHandler) startRelay() {
+	format := h.stream.Format
+	if format == "" {
+		format = archive.Zip
+	}
+
+	spool := &tunnel.Spool{
+		Filename:    trimExt(h.streamDetails.Filename) + format.Ext(),
+		ContentType: format.ContentType(),
+		Format:      format,
+	}
+	body := h.stream.Relay(spool)
+
+	// the archive is only known once it has been relayed, its checksum is
+	// handed over when done
+	checksum := sha256.New()
+	relay, err := newRelay(io.MultiWriter(&flushWriter{w: body}, checksum), format, h.staging, h.streamDetails.SpoolKey)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+
+	h.mutex.Lock()
+	h.relay = relay
+	h.relayChecksum = checksum
+	h.relaySpool = spool
+	entries := append([]*stagedEntry(nil), h.entries...)
+	h.mutex.Unlock()
+
+	for _, entry := range entries {
+		if err := relay.writeEntry(&entry.header); err != nil {
+			slog.Error(err.Error())
+			return
+		}
+	}
+}
+
+func (h *sftpHandler) currentRelay() *relay {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.relay
+}
+
+// relayEntry writes a directory or symlink to the recipient once the
+// upload is being relayed.
+func (h *sftpHandler) relayEntry(entry *stagedEntry) error {
+	relay := h.currentRelay()
+	if relay == nil {
 		return nil
 	}
-	return sftp.ErrSshFxOpUnsupported
+
+	return relay.writeEntry(&entry.header)
+}
+
+// singleFile returns the uploaded file when it was the only thing sent.
+func (h *sftpHandler) singleFile() (*stagedEntry, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.entries) != 1 || !h.entries[0].header.Mode.IsRegular() {
+		return nil, false
+	}
+
+	return h.entries[0], true
+}
+
+func (h *sftpHandler) writeEntries(w archive.Writer) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, entry := range h.entries {
+		var content io.Reader
+		if entry.header.Mode.IsRegular() {
+			file, err := entry.file.Open()
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			content = file
+		}
+
+		if err := w.WriteEntry(&entry.header, content); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *sftpHandler) written(amount int) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.totalSize += int64(amount)
+	h.progress.add(amount)
+	if h.quota.exceeded(h.totalSize) && h.limitErr == nil {
+		h.limitErr = h.quota.limitError()
+		fmt.Fprintf(h.stderr, "\n\n%v\n\n", h.limitErr)
+		h.server.Close()
+	}
+
+	return h.limitErr
 }
 
-func (h *sftpHandler) WriteAt(p []byte, off int64) (n int, err error) {
-	amount, err := h.fileWriter.Write(p)
+// relayedFile counts the bytes of a relayed file against the quota.
+type relayedFile struct {
+	writerAtCloser
+	handler *sftpHandler
+}
+
+func (f *relayedFile) WriteAt(p []byte, off int64) (int, error) {
+	amount, err := f.writerAtCloser.WriteAt(p, off)
 	if err != nil {
 		return 0, err
 	}
 
-	*h.totalSize = *h.totalSize + amount
-	if *h.totalSize >= limit {
-		fmt.Fprintf(h.stderr, "\n\n%v\n\n", maxLimitError)
-		h.server.Close()
-		return 0, maxLimitError
+	if err := f.handler.written(amount); err != nil {
+		return 0, err
 	}
 
 	return amount, nil
 }
+
+// flushWriter flushes every write, so the recipient receives the relayed
+// upload while it is being sent.
+type flushWriter struct {
+	w io.Writer
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	return n, err
+}
+
+// stagedFile writes an uploaded file into the staging directory, it is
+// closed by the sftp server once the transfer of the file is done. Writes
+// are ordered since the file is sealed as a stream.
+type stagedFile struct {
+	*orderedWriter
+	entry   *stagedEntry
+	handler *sftpHandler
+}
+
+func (f *stagedFile) WriteAt(p []byte, off int64) (int, error) {
+	amount, err := f.orderedWriter.WriteAt(p, off)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := f.handler.written(amount); err != nil {
+		return 0, err
+	}
+
+	return amount, nil
+}
+
+func (f *stagedFile) Close() error {
+	if err := f.complete(); err != nil {
+		f.entry.file.Close()
+		return err
+	}
+
+	f.handler.mutex.Lock()
+	f.entry.header.Size = f.entry.file.Size()
+	f.handler.mutex.Unlock()
+
+	return f.entry.file.Close()
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"trisend/internal/config"
+	"trisend/internal/seal"
+	"trisend/internal/tunnel"
+	"trisend/internal/tunnel/tunneltest"
+
+	"github.com/pkg/sftp"
+)
+
+func TestEntryName(t *testing.T) {
+	handler := &sftpHandler{}
+
+	tests := []struct {
+		requested string
+		name      string
+		rejected  bool
+	}{
+		{"/uploads/project", "project", false},
+		{"/uploads/project/src/main.go", "project/src/main.go", false},
+		{"/uploads/project/../project/empty", "project/empty", false},
+		{"/uploads/../etc/passwd", "", true},
+		{"/other/file.txt", "", true},
+		{"/uploads", "", true},
+	}
+
+	for _, test := range tests {
+		name, err := handler.entryName(test.requested)
+		if test.rejected {
+			if err == nil {
+				t.Errorf("expected %s to be rejected, got %s", test.requested, name)
+			}
+			continue
+		}
+		if err != nil || name != test.name {
+			t.Errorf("expected %s to become %s, got %s %v", test.requested, test.name, name, err)
+		}
+	}
+}
+
+func TestCheckLinkname(t *testing.T) {
+	valid := map[string]string{
+		"project/latest":     "run.sh",
+		"project/src/config": "../config.yml",
+	}
+	for name, linkname := range valid {
+		if err := checkLinkname(name, linkname); err != nil {
+			t.Errorf("expected %s -> %s to be allowed, got %v", name, linkname, err)
+		}
+	}
+
+	invalid := map[string]string{
+		"project/passwd": "/etc/passwd",
+		"project/up":     "../../home",
+		"latest":         "..",
+	}
+	for name, linkname := range invalid {
+		if err := checkLinkname(name, linkname); err == nil {
+			t.Errorf("expected %s -> %s to be rejected", name, linkname)
+		}
+	}
+}
+
+func TestWaitContext(t *testing.T) {
+	session, end := context.WithCancel(context.Background())
+	stopping, stop := context.WithCancel(context.Background())
+
+	ctx, cancel := waitContext(session, stopping)
+	stop()
+	<-ctx.Done()
+	if cause := context.Cause(ctx); !errors.Is(cause, errShuttingDown) {
+		t.Errorf("expected errShuttingDown, got %v", cause)
+	}
+	cancel()
+
+	ctx, cancel = waitContext(session, context.Background())
+	defer cancel()
+	end()
+	<-ctx.Done()
+	if cause := context.Cause(ctx); !errors.Is(cause, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", cause)
+	}
+}
+
+// syncBuffer is the stderr of a test session, written by the sftp server
+// while the test reads it.
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Read(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.buf.Read(p)
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.buf.String()
+}
+
+// newTestSFTP serves an upload session over an in-memory pipe and returns
+// its handler, its stderr and a connected client.
+func newTestSFTP(t *testing.T) (*sftpHandler, *syncBuffer, *sftp.Client) {
+	key, err := seal.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stderr := &syncBuffer{}
+	handler := newSFTPHandler(
+		context.Background(),
+		stderr,
+		t.TempDir(),
+		nil,
+		newProgress(stderr, false, 0),
+		tunneltest.NewRegistry(t),
+		&downloadHistory{},
+		&tunnel.StreamDetails{UserID: "bob", SpoolKey: key},
+	)
+
+	serverConn, clientConn := net.Pipe()
+	handler.server = sftp.NewRequestServer(serverConn, handler.Build())
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		handler.server.Serve()
+	}()
+
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		handler.server.Close()
+		<-served
+	})
+
+	return handler, stderr, client
+}
+
+func TestSFTPUploadExpires(t *testing.T) {
+	// restored once the session is over, it still reads the expiry
+	defaultExpiry := config.DEFAULT_EXPIRY
+	config.DEFAULT_EXPIRY = 50 * time.Millisecond
+	t.Cleanup(func() { config.DEFAULT_EXPIRY = defaultExpiry })
+
+	handler, stderr, client := newTestSFTP(t)
+
+	started := time.Now()
+	if _, err := client.Create("/uploads/report.pdf"); err == nil {
+		t.Fatal("expected the upload to fail once the link expired")
+	}
+
+	// the link lives for DEFAULT_EXPIRY, sftp has no --expires
+	if expires := handler.streamDetails.Expires.Sub(started); expires < config.DEFAULT_EXPIRY || expires > time.Second {
+		t.Errorf("expected the link to expire after %s, got %s", config.DEFAULT_EXPIRY, expires)
+	}
+	if !strings.Contains(stderr.String(), expirationError(config.DEFAULT_EXPIRY).Error()) {
+		t.Errorf("expected the sender to be told the link expired, got %q", stderr.String())
+	}
+	if _, ok := handler.registry.GetStreamDetails(handler.id); ok {
+		t.Error("expected the expired transfer to be deleted")
+	}
+}
+
+func TestSFTPStoreForwardExpiry(t *testing.T) {
+	storeForward := config.STORE_FORWARD
+	config.STORE_FORWARD = true
+	t.Cleanup(func() { config.STORE_FORWARD = storeForward })
+
+	handler, _, client := newTestSFTP(t)
+
+	started := time.Now()
+	file, err := client.Create("/uploads/report.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	details, ok := handler.registry.GetStreamDetails(handler.id)
+	if !ok {
+		t.Fatal("expected the transfer to be registered")
+	}
+	if expires := details.Expires.Sub(started); expires < config.DEFAULT_EXPIRY || expires > config.DEFAULT_EXPIRY+time.Second {
+		t.Errorf("expected the link to expire after %s, got %s", config.DEFAULT_EXPIRY, expires)
+	}
+	if details.Filename != "report.pdf" {
+		t.Errorf("expected the filename report.pdf, got %s", details.Filename)
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"trisend/internal/seal"
+)
+
+// sealedTemp is a temp file encrypted with the spool key of its transfer,
+// what a crash leaves behind can not be read without the key that only
+// lived in memory. It is written once from start to end, then read with
+// Open. The plaintext is hashed on its way to the disk.
+type sealedTemp struct {
+	mutex  sync.Mutex
+	file   *os.File
+	key    []byte
+	writer io.WriteCloser
+	size   int64
+	hash   hash.Hash
+}
+
+func createSealedTemp(dir, pattern string, key []byte) (*sealedTemp, error) {
+	file, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := seal.NewWriter(file, key)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return &sealedTemp{file: file, key: key, writer: writer, hash: sha256.New()}, nil
+}
+
+func (t *sealedTemp) Write(p []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.writer == nil {
+		return 0, errors.New("write to a finished temp file")
+	}
+
+	n, err := t.writer.Write(p)
+	t.size += int64(n)
+	t.hash.Write(p[:n])
+
+	return n, err
+}
+
+// Size returns the amount of plaintext written.
+func (t *sealedTemp) Size() int64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.size
+}
+
+// Checksum returns the hex SHA-256 of the plaintext written.
+func (t *sealedTemp) Checksum() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return hex.EncodeToString(t.hash.Sum(nil))
+}
+
+// Close finishes the file, nothing can be written to it anymore.
+func (t *sealedTemp) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.writer == nil {
+		return nil
+	}
+
+	err := t.writer.Close()
+	t.writer = nil
+	if closeErr := t.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Open finishes the file and returns its plaintext, every reader has its
+// own offset.
+func (t *sealedTemp) Open() (*sealedReader, error) {
+	if err := t.Close(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(t.file.Name())
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	seeker, err := seal.NewSeeker(file, info.Size(), t.key)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &sealedReader{Seeker: seeker, file: file}, nil
+}
+
+// Remove closes and deletes the file.
+func (t *sealedTemp) Remove() error {
+	t.Close()
+	return os.Remove(t.file.Name())
+}
+
+type sealedReader struct {
+	*seal.Seeker
+	file *os.File
+}
+
+func (r *sealedReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestSealedTemp(t *testing.T) {
+	temp, err := createSealedTemp(t.TempDir(), "file-*", testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer temp.Remove()
+
+	if _, err := io.WriteString(temp, "secret notes"); err != nil {
+		t.Fatal(err)
+	}
+	content, err := temp.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+
+	onDisk, err := os.ReadFile(temp.file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(onDisk, []byte("secret")) {
+		t.Errorf("expected the temp file to be sealed, got %q", onDisk)
+	}
+
+	content.Seek(7, io.SeekStart)
+	data, err := io.ReadAll(content)
+	if err != nil || string(data) != "notes" {
+		t.Errorf("expected notes, got %q %v", data, err)
+	}
+	if temp.Size() != 12 {
+		t.Errorf("expected a size of 12, got %d", temp.Size())
+	}
+	if sum := sha256.Sum256([]byte("secret notes")); temp.Checksum() != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected the checksum of the plaintext, got %s", temp.Checksum())
+	}
+}
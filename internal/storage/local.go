@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// putPrefix names the files of uploads that are still being written
+const putPrefix = "put-"
+
+type localStorage struct {
+	dir string
+}
+
+func NewLocalStorage(dir string) (Storage, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	return &localStorage{
+		dir: dir,
+	}, nil
+}
+
+func (s *localStorage) path(key string) string {
+	return filepath.Join(s.dir, filepath.Base(key))
+}
+
+func (s *localStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	file, err := os.CreateTemp(s.dir, putPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), s.path(key))
+}
+
+func (s *localStorage) Open(ctx context.Context, key string) (Object, error) {
+	file, err := os.Open(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &localObject{
+		File: file,
+		info: info,
+	}, nil
+}
+
+func (s *localStorage) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *localStorage) Purge(ctx context.Context, keep func(key string) bool, before time.Time) (int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return purged, err
+		}
+		if entry.IsDir() {
+			continue
+		}
+
+		name := entry.Name()
+		if strings.HasPrefix(name, putPrefix) {
+			info, err := entry.Info()
+			if err != nil || info.ModTime().After(before) {
+				continue
+			}
+		} else if keep(name) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return purged, err
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+type localObject struct {
+	*os.File
+	info fs.FileInfo
+}
+
+func (o *localObject) Size() int64 {
+	return o.info.Size()
+}
+
+func (o *localObject) ModTime() time.Time {
+	return o.info.ModTime()
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"trisend/internal/config"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// Storage keeps uploaded transfers so recipients can download them after
+// the sender has disconnected.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Open(ctx context.Context, key string) (Object, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Purger is implemented by the storages that can list their objects, so
+// objects left behind by a crash can be found and deleted.
+type Purger interface {
+	// Purge deletes the objects for which keep returns false and the
+	// unfinished uploads last written before before. It returns the amount
+	// of deleted objects.
+	Purge(ctx context.Context, keep func(key string) bool, before time.Time) (int, error)
+}
+
+type Object interface {
+	io.ReadSeekCloser
+	Size() int64
+	ModTime() time.Time
+}
+
+// NewStorage builds the backend selected with STORAGE_DRIVER, uploads are
+// kept on the local filesystem by default.
+func NewStorage() (Storage, error) {
+	switch config.STORAGE_DRIVER {
+	case "", "local":
+		return NewLocalStorage(config.STORAGE_DIR)
+	case "s3":
+		return NewS3Storage(S3Config{
+			Endpoint:  config.S3_ENDPOINT,
+			Bucket:    config.S3_BUCKET,
+			Region:    config.S3_REGION,
+			AccessKey: config.S3_ACCESS_KEY,
+			SecretKey: config.S3_SECRET_KEY,
+		})
+	}
+
+	return nil, fmt.Errorf("unknown storage driver: %s", config.STORAGE_DRIVER)
+}
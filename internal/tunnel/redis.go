@@ -0,0 +1,301 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+	"trisend/internal/storage"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ForwardedHeader marks requests proxied between instances, so a request
+// is never forwarded twice.
+const ForwardedHeader = "X-Trisend-Forwarded"
+
+// RedisRegistry shares the details of transfers with the other instances
+// through Redis, so any of them can render the download page and hand the
+// download over to the instance the sender is connected to. Senders and
+// spools stay in the memory of their instance.
+type RedisRegistry struct {
+	*MemoryRegistry
+	rdb *redis.Client
+	// sharedMutex guards shared and order, shared holds the latest details
+	// of each transfer waiting to be saved in Redis
+	sharedMutex sync.Mutex
+	shared      map[string]StreamDetails
+	order       []string
+	wake        chan struct{}
+}
+
+// NewRedisRegistry returns a registry shared through client, node is the
+// URL other instances reach this one with.
+func NewRedisRegistry(store storage.Storage, client *redis.Client, node string) *RedisRegistry {
+	registry := &RedisRegistry{
+		MemoryRegistry: NewMemoryRegistry(store),
+		rdb:            client,
+		shared:         map[string]StreamDetails{},
+		wake:           make(chan struct{}, 1),
+	}
+	registry.node = node
+	registry.onChange = registry.share
+	registry.dropOrphans(context.Background())
+
+	go registry.shareDetails()
+
+	return registry
+}
+
+func streamKey(key string) string {
+	return "stream:" + key
+}
+
+func passwordKey(key string) string {
+	return "stream:" + key + ":password"
+}
+
+func eventsChannel(key string) string {
+	return "stream:" + key + ":events"
+}
+
+// GetStreamDetails looks up the other instances when the transfer is not
+// local.
+func (r *RedisRegistry) GetStreamDetails(key string) (*StreamDetails, bool) {
+	if details, ok := r.MemoryRegistry.GetStreamDetails(key); ok {
+		return details, true
+	} else if r.IsLocal(key) {
+		return nil, false
+	}
+
+	return r.remoteDetails(key)
+}
+
+// Subscribe follows transfers of other instances through Redis.
+func (r *RedisRegistry) Subscribe(key string) (<-chan StreamDetails, func(), bool) {
+	if r.IsLocal(key) {
+		return r.MemoryRegistry.Subscribe(key)
+	}
+
+	ctx := context.Background()
+	// subscribe before loading the details, so no update is missed
+	pubsub := r.rdb.Subscribe(ctx, eventsChannel(key))
+
+	details, ok := r.remoteDetails(key)
+	if !ok {
+		pubsub.Close()
+		return nil, nil, false
+	}
+
+	subscriber := make(chan StreamDetails, 1)
+	subscriber <- *details
+
+	go func() {
+		defer close(subscriber)
+
+		for message := range pubsub.Channel() {
+			current := StreamDetails{}
+			if err := json.Unmarshal([]byte(message.Payload), &current); err != nil {
+				slog.Error(err.Error())
+				continue
+			}
+
+			select {
+			case <-subscriber:
+			default:
+			}
+			subscriber <- current
+
+			if current.Status == StatusExpired {
+				pubsub.Close()
+				return
+			}
+		}
+	}()
+
+	unsubscribe := func() {
+		pubsub.Close()
+	}
+
+	return subscriber, unsubscribe, true
+}
+
+// deleteAttempts bounds the retries of deleting an expired transfer from
+// Redis, other instances would keep advertising it otherwise.
+const deleteAttempts = 5
+
+// share queues the details of a local transfer to be saved in Redis, it
+// is called with the mutex held so the network is left to shareDetails.
+// Updates of a transfer still waiting are replaced by the latest one, so
+// a slow Redis never loses the last state of a transfer.
+func (r *RedisRegistry) share(details StreamDetails) {
+	r.sharedMutex.Lock()
+	if previous, ok := r.shared[details.ID]; !ok {
+		r.order = append(r.order, details.ID)
+	} else {
+		slog.Debug("tunnel: replaced the pending update of stream "+details.ID, "status", previous.Status)
+	}
+	r.shared[details.ID] = details
+	r.sharedMutex.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// nextShared takes the oldest transfer waiting to be shared.
+func (r *RedisRegistry) nextShared() (StreamDetails, bool) {
+	r.sharedMutex.Lock()
+	defer r.sharedMutex.Unlock()
+
+	if len(r.order) == 0 {
+		return StreamDetails{}, false
+	}
+	id := r.order[0]
+	r.order = r.order[1:]
+	details := r.shared[id]
+	delete(r.shared, id)
+
+	return details, true
+}
+
+// shareDetails saves the queued details in order and publishes them to
+// the subscribers on other instances.
+func (r *RedisRegistry) shareDetails() {
+	for range r.wake {
+		for {
+			details, ok := r.nextShared()
+			if !ok {
+				break
+			}
+			r.saveDetails(details)
+		}
+	}
+}
+
+func (r *RedisRegistry) saveDetails(details StreamDetails) {
+	ctx := context.Background()
+
+	data, err := json.Marshal(details)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+
+	if details.Status == StatusExpired {
+		err = r.deleteDetails(ctx, details.ID)
+	} else if ttl := time.Until(details.Expires); ttl > 0 {
+		// the hash lands together with the details, so no instance
+		// sees a password transfer without its hash
+		pipe := r.rdb.TxPipeline()
+		if len(details.PasswordHash) > 0 {
+			pipe.Set(ctx, passwordKey(details.ID), details.PasswordHash, ttl)
+		}
+		pipe.Set(ctx, streamKey(details.ID), data, ttl)
+		_, err = pipe.Exec(ctx)
+	}
+	if err != nil {
+		slog.Error(err.Error())
+	}
+
+	if err := r.rdb.Publish(ctx, eventsChannel(details.ID), data).Err(); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+// deleteDetails removes an expired transfer, retrying while Redis is
+// unavailable.
+func (r *RedisRegistry) deleteDetails(ctx context.Context, key string) error {
+	var err error
+	for attempt := 1; attempt <= deleteAttempts; attempt++ {
+		if err = r.rdb.Del(ctx, streamKey(key), passwordKey(key)).Err(); err == nil {
+			return nil
+		}
+		time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+	}
+
+	return errors.New("tunnel: could not delete stream " + key + ": " + err.Error())
+}
+
+// dropOrphans deletes the transfers a previous run of this instance left
+// in Redis. Their spools are sealed with keys that only lived in its
+// memory, so they can not be served anymore and are deleted as well.
+func (r *RedisRegistry) dropOrphans(ctx context.Context) {
+	dropped := 0
+	iter := r.rdb.Scan(ctx, 0, streamKey("*"), 0).Iterator()
+	for iter.Next(ctx) {
+		key := strings.TrimPrefix(iter.Val(), streamKey(""))
+		// password hashes go with their transfer
+		if strings.Contains(key, ":") || r.IsLocal(key) {
+			continue
+		}
+
+		data, err := r.rdb.Get(ctx, streamKey(key)).Bytes()
+		if err != nil {
+			continue
+		}
+		details := StreamDetails{}
+		if err := json.Unmarshal(data, &details); err != nil || details.Node != r.node {
+			continue
+		}
+
+		if err := r.deleteDetails(ctx, key); err != nil {
+			slog.Error(err.Error())
+			continue
+		}
+		details.Status = StatusExpired
+		if data, err := json.Marshal(details); err == nil {
+			r.rdb.Publish(ctx, eventsChannel(key), data)
+		}
+		if err := r.store.Delete(ctx, key); err != nil {
+			slog.Error(err.Error())
+		}
+		dropped++
+	}
+	if err := iter.Err(); err != nil {
+		slog.Error(err.Error())
+	}
+
+	if dropped > 0 {
+		slog.Info(fmt.Sprintf("Dropped %d transfers left by a previous run", dropped))
+	}
+}
+
+// remoteDetails loads the details of a transfer whose sender is connected
+// to another instance.
+func (r *RedisRegistry) remoteDetails(key string) (*StreamDetails, bool) {
+	ctx := context.Background()
+	data, err := r.rdb.Get(ctx, streamKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false
+	} else if err != nil {
+		slog.Error(err.Error())
+		return nil, false
+	}
+
+	details := new(StreamDetails)
+	if err := json.Unmarshal(data, details); err != nil {
+		slog.Error(err.Error())
+		return nil, false
+	}
+	// a transfer of this instance that is not in its memory was left by a
+	// previous run, its spool can not be decrypted anymore
+	if time.Now().After(details.Expires) || details.Node == r.node {
+		return nil, false
+	}
+
+	if details.Visibility == VisibilityPassword {
+		details.PasswordHash, err = r.rdb.Get(ctx, passwordKey(key)).Bytes()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			slog.Error(err.Error())
+			return nil, false
+		}
+	}
+
+	return details, true
+}
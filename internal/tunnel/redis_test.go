@@ -0,0 +1,275 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestNodes returns the registries of two instances sharing one Redis.
+func newTestNodes(t *testing.T) (*miniredis.Miniredis, *redis.Client, *RedisRegistry, *RedisRegistry) {
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	a := NewRedisRegistry(newTestRegistry(t).store, rdb, "http://a")
+	b := NewRedisRegistry(newTestRegistry(t).store, rdb, "http://b")
+
+	return server, rdb, a, b
+}
+
+// eventually fails the test when condition does not hold within a second,
+// the details reach Redis in the background.
+func eventually(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRedisRegistrySharesDetails(t *testing.T) {
+	server, rdb, a, b := newTestNodes(t)
+	ctx := context.Background()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := rdb.Subscribe(ctx, eventsChannel("abc"))
+	defer events.Close()
+	if _, err := events.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	a.SetStream("abc", make(chan Stream), &StreamDetails{
+		Expires:      time.Now().Add(time.Minute),
+		Visibility:   VisibilityPassword,
+		PasswordHash: hash,
+	})
+
+	var details *StreamDetails
+	eventually(t, func() bool {
+		details, _ = b.GetStreamDetails("abc")
+		return details != nil
+	})
+	if b.IsLocal("abc") || details.Node != "http://a" {
+		t.Errorf("expected a transfer of http://a, got %q", details.Node)
+	}
+	if !details.CheckPassword("secret") {
+		t.Error("expected the other instance to check the password")
+	}
+
+	// the hash is kept under its own key, out of what subscribers receive
+	stored, err := server.Get(streamKey("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stored, "PasswordHash") {
+		t.Errorf("expected no password hash in the details, got %s", stored)
+	}
+	message, err := events.ReceiveMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(message.Payload, "PasswordHash") {
+		t.Errorf("expected no password hash in the event, got %s", message.Payload)
+	}
+
+	for _, key := range []string{streamKey("abc"), passwordKey("abc")} {
+		if ttl := server.TTL(key); ttl <= 0 || ttl > time.Minute {
+			t.Errorf("expected %s to expire with the transfer, got %v", key, ttl)
+		}
+	}
+}
+
+func TestRedisRegistryTakeStream(t *testing.T) {
+	_, _, a, b := newTestNodes(t)
+
+	stream := make(chan Stream)
+	a.SetStream("abc", stream, testDetails())
+	eventually(t, func() bool {
+		_, ok := b.GetStreamDetails("abc")
+		return ok
+	})
+
+	// the sender waits on the instance it is connected to
+	if _, ok := b.TakeStream("abc"); ok {
+		t.Error("expected the stream of another instance not to be taken")
+	}
+	if taken, ok := a.TakeStream("abc"); !ok || taken != stream {
+		t.Fatal("expected the instance of the sender to hand the stream out")
+	}
+	if _, ok := a.TakeStream("abc"); ok {
+		t.Error("expected the stream to be taken only once")
+	}
+}
+
+func TestRedisRegistryExpire(t *testing.T) {
+	server, _, a, b := newTestNodes(t)
+
+	a.SetStream("abc", make(chan Stream), testDetails())
+	eventually(t, func() bool {
+		_, ok := b.GetStreamDetails("abc")
+		return ok
+	})
+
+	subscriber, unsubscribe, ok := b.Subscribe("abc")
+	if !ok {
+		t.Fatal("expected to follow the transfer of another instance")
+	}
+	defer unsubscribe()
+	<-subscriber
+
+	// the subscription is confirmed asynchronously, updates are sent until
+	// one arrives
+	eventually(t, func() bool {
+		a.SetUploaded("abc", 1)
+		select {
+		case details := <-subscriber:
+			return details.Uploaded == 1
+		case <-time.After(10 * time.Millisecond):
+			return false
+		}
+	})
+
+	a.DeleteStream("abc")
+	for details := range subscriber {
+		if details.Status != StatusExpired {
+			continue
+		}
+		if _, open := <-subscriber; open {
+			t.Error("expected the subscriber to be closed after the expiry")
+		}
+		break
+	}
+	eventually(t, func() bool {
+		return !server.Exists(streamKey("abc"))
+	})
+	if _, ok := b.GetStreamDetails("abc"); ok {
+		t.Error("expected the deleted transfer to be gone on the other instance")
+	}
+
+	// transfers also leave Redis once their link expires
+	a.SetStream("xyz", make(chan Stream), testDetails())
+	eventually(t, func() bool {
+		return server.Exists(streamKey("xyz"))
+	})
+	server.FastForward(time.Minute)
+	if _, ok := b.GetStreamDetails("xyz"); ok {
+		t.Error("expected the expired transfer to be gone on the other instance")
+	}
+}
+
+func TestRedisRegistryCoalescesUpdates(t *testing.T) {
+	server, _, a, b := newTestNodes(t)
+
+	// more updates than Redis keeps up with, only the latest of each
+	// transfer has to land and the expiry is never lost
+	for _, key := range []string{"abc", "xyz"} {
+		a.SetStream(key, make(chan Stream), testDetails())
+	}
+	for uploaded := range int64(5000) {
+		a.SetUploaded("abc", uploaded)
+		a.SetUploaded("xyz", uploaded)
+	}
+	a.DeleteStream("abc")
+
+	eventually(t, func() bool {
+		details, ok := b.GetStreamDetails("xyz")
+		return ok && details.Uploaded == 4999
+	})
+	eventually(t, func() bool {
+		return !server.Exists(streamKey("abc"))
+	})
+}
+
+func TestRedisRegistrySpoolHandOff(t *testing.T) {
+	_, _, a, b := newTestNodes(t)
+	ctx := context.Background()
+
+	a.SetStream("abc", make(chan Stream), testDetails())
+
+	// the first recipient starts the upload, the next one waits for the spool
+	if stream, err := a.WaitStream(ctx, "abc"); err != nil || stream == nil {
+		t.Fatalf("expected the first recipient to get the stream, got %v", err)
+	}
+	waiting := make(chan error, 1)
+	go func() {
+		stream, err := a.WaitStream(ctx, "abc")
+		if err == nil && stream != nil {
+			err = io.ErrUnexpectedEOF
+		}
+		waiting <- err
+	}()
+
+	err := a.StoreSpool(ctx, "abc", strings.NewReader("hello"), 5, &Spool{Filename: "hello.txt", Checksum: "sum"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-waiting; err != nil {
+		t.Errorf("expected the waiting recipient to be handed the spool, got %v", err)
+	}
+
+	object, _, err := a.OpenSpool(ctx, "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer object.Close()
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, object); err != nil || out.String() != "hello" {
+		t.Errorf("expected hello, got %q %v", out.String(), err)
+	}
+
+	// the other instance sees the upload complete, the spool stays local
+	eventually(t, func() bool {
+		details, ok := b.GetStreamDetails("abc")
+		return ok && details.Status == StatusCompleted && details.Size == 5 && details.Checksum == "sum"
+	})
+	if _, ok := b.GetSpool("abc"); ok {
+		t.Error("expected the spool to stay on the instance of the sender")
+	}
+}
+
+func TestRedisRegistryDropsOrphans(t *testing.T) {
+	server, rdb, a, b := newTestNodes(t)
+	ctx := context.Background()
+
+	a.SetStream("abc", make(chan Stream), testDetails())
+	b.SetStream("xyz", make(chan Stream), testDetails())
+	if err := a.StoreSpool(ctx, "abc", strings.NewReader("hello"), 5, &Spool{Filename: "hello.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool {
+		details, ok := b.GetStreamDetails("abc")
+		return ok && details.Status == StatusCompleted && server.Exists(streamKey("xyz"))
+	})
+
+	// a restarts, the key of its spool is gone with its memory
+	restarted := NewRedisRegistry(a.store, rdb, "http://a")
+
+	if server.Exists(streamKey("abc")) {
+		t.Error("expected the transfer of the previous run to leave Redis")
+	}
+	if _, ok := b.GetStreamDetails("abc"); ok {
+		t.Error("expected the orphaned transfer to be gone on the other instance")
+	}
+	if _, err := restarted.store.Open(ctx, "abc"); err == nil {
+		t.Error("expected the orphaned spool to be deleted")
+	}
+	if _, ok := restarted.GetStreamDetails("xyz"); !ok {
+		t.Error("expected the transfers of other instances to be kept")
+	}
+}
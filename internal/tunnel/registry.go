@@ -0,0 +1,556 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+	"trisend/internal/seal"
+	"trisend/internal/storage"
+)
+
+// Registry keeps track of the transfers, their senders waiting for a
+// recipient and the uploads spooled to storage.
+type Registry interface {
+	// SetStream registers a transfer. A nil stream registers a transfer whose
+	// sender does not wait for a recipient and is only served from its spool.
+	SetStream(key string, stream chan Stream, details *StreamDetails)
+	GetStream(key string) (chan Stream, bool)
+	// TakeStream returns the stream channel and removes it, so only one
+	// recipient can hand its request over to the sender.
+	TakeStream(key string) (chan Stream, bool)
+	// ReturnStream hands a channel taken with TakeStream back, when the
+	// recipient gave up before the sender received its request.
+	ReturnStream(key string, stream chan Stream)
+	// WaitStream takes the stream channel for the first recipient, the
+	// others wait until the upload is spooled or the channel is returned.
+	// The channel is nil once the upload is spooled, ErrExpired is returned
+	// when the transfer expires or is deleted first.
+	WaitStream(ctx context.Context, key string) (chan Stream, error)
+	// WaitRecipient blocks until a recipient takes the stream. It returns
+	// ErrExpired when the link expires first or the error of ctx.
+	WaitRecipient(ctx context.Context, key string) (*Stream, error)
+	// GetStreamDetails returns a snapshot of the details of a transfer that
+	// has not expired yet.
+	GetStreamDetails(key string) (*StreamDetails, bool)
+	// IsLocal reports whether the sender of the transfer is connected to
+	// this instance.
+	IsLocal(key string) bool
+	// SetStatus changes the status of a transfer and notifies its subscribers.
+	SetStatus(key string, status Status)
+	// SetUploaded records how much of a transfer the sender has uploaded.
+	SetUploaded(key string, uploaded int64)
+	// SetChecksum records the checksum of a relayed upload, spooled ones
+	// get it from their spool.
+	SetChecksum(key string, checksum string)
+	// CompleteDownload counts a finished download of the transfer and retires
+	// it once the maximum amount of downloads has been reached.
+	CompleteDownload(key string)
+	// Subscribe returns a channel receiving a snapshot of the details of the
+	// transfer every time they change, starting with the current ones. The
+	// channel is closed once the transfer is deleted, unsubscribe has to be
+	// called when the subscriber stops reading before that.
+	Subscribe(key string) (<-chan StreamDetails, func(), bool)
+	// StoreSpool saves an upload to storage and registers it as the spool of
+	// the stream. The object is deleted together with the stream once it expires.
+	StoreSpool(ctx context.Context, key string, r io.Reader, size int64, spool *Spool) error
+	GetSpool(key string) (*Spool, bool)
+	OpenSpool(ctx context.Context, key string) (storage.Object, *Spool, error)
+	DeleteStream(key string)
+	// OnDelete registers a function called with the last details of every
+	// transfer of this instance once it is deleted.
+	OnDelete(callback func(details StreamDetails))
+	// Purge deletes the expired transfers and the spooled uploads no transfer
+	// refers to anymore, including unfinished ones written before before.
+	Purge(ctx context.Context, before time.Time) (streams int, spools int, err error)
+}
+
+// MemoryRegistry keeps the transfers in process memory.
+type MemoryRegistry struct {
+	mutex      sync.RWMutex
+	streamings map[string]chan Stream
+	// senders keeps the stream channels once a recipient has taken them,
+	// so the sender can still wait on its channel
+	senders map[string]chan Stream
+	// expired is closed once the transfer is deleted, waking up its sender
+	expired map[string]chan struct{}
+	// returned is closed every time a stream channel is handed back, waking
+	// up the recipients waiting in WaitStream
+	returned      map[string]chan struct{}
+	spools        map[string]*Spool
+	spoolReady    map[string]chan struct{}
+	streamDetails map[string]*StreamDetails
+	subscribers   map[string][]chan StreamDetails
+	store         storage.Storage
+
+	// node is set on the details of new transfers
+	node string
+	// onChange is called with the mutex held every time details change
+	onChange func(details StreamDetails)
+	onDelete []func(details StreamDetails)
+}
+
+// NewMemoryRegistry returns a registry keeping spooled uploads in store.
+func NewMemoryRegistry(store storage.Storage) *MemoryRegistry {
+	return &MemoryRegistry{
+		streamings:    map[string]chan Stream{},
+		senders:       map[string]chan Stream{},
+		expired:       map[string]chan struct{}{},
+		returned:      map[string]chan struct{}{},
+		spools:        map[string]*Spool{},
+		spoolReady:    map[string]chan struct{}{},
+		streamDetails: map[string]*StreamDetails{},
+		subscribers:   map[string][]chan StreamDetails{},
+		store:         store,
+	}
+}
+
+// SetStream registers a transfer, it keeps a copy of details so the
+// caller is free to reuse them.
+func (r *MemoryRegistry) SetStream(key string, stream chan Stream, details *StreamDetails) {
+	value := *details
+	if value.MaxDownloads < 1 {
+		value.MaxDownloads = 1
+	}
+	if value.Visibility == "" {
+		value.Visibility = VisibilityPrivate
+	}
+	value.Status = StatusWaiting
+	if stream == nil {
+		value.Status = StatusUploading
+	}
+	value.ID = key
+	value.Node = r.node
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.streamDetails[key] = &value
+	r.spoolReady[key] = make(chan struct{})
+	r.expired[key] = make(chan struct{})
+	r.returned[key] = make(chan struct{})
+	if stream != nil {
+		r.streamings[key] = stream
+		r.senders[key] = stream
+	}
+	r.notify(key)
+}
+
+func (r *MemoryRegistry) GetStream(key string) (chan Stream, bool) {
+	if _, ok := r.GetStreamDetails(key); !ok {
+		return nil, false
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	stream, ok := r.streamings[key]
+
+	return stream, ok
+}
+
+func (r *MemoryRegistry) TakeStream(key string) (chan Stream, bool) {
+	if _, ok := r.GetStreamDetails(key); !ok {
+		return nil, false
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	stream, ok := r.streamings[key]
+	delete(r.streamings, key)
+
+	return stream, ok
+}
+
+func (r *MemoryRegistry) ReturnStream(key string, stream chan Stream) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	returned, ok := r.returned[key]
+	if !ok {
+		return
+	}
+	if _, taken := r.streamings[key]; taken {
+		return
+	}
+	r.streamings[key] = stream
+
+	close(returned)
+	r.returned[key] = make(chan struct{})
+}
+
+func (r *MemoryRegistry) WaitStream(ctx context.Context, key string) (chan Stream, error) {
+	for {
+		details, ok := r.GetStreamDetails(key)
+		if !ok {
+			return nil, ErrExpired
+		}
+
+		r.mutex.Lock()
+		stream, ok := r.streamings[key]
+		delete(r.streamings, key)
+		_, spooled := r.spools[key]
+		ready, waiting := r.spoolReady[key]
+		returned := r.returned[key]
+		r.mutex.Unlock()
+
+		if ok {
+			return stream, nil
+		} else if spooled {
+			return nil, nil
+		} else if !waiting {
+			return nil, ErrExpired
+		}
+
+		select {
+		case <-ready:
+			if _, ok := r.GetSpool(key); !ok {
+				return nil, ErrExpired
+			}
+			return nil, nil
+		case <-returned:
+		case <-time.After(time.Until(details.Expires)):
+			return nil, ErrExpired
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (r *MemoryRegistry) WaitRecipient(ctx context.Context, key string) (*Stream, error) {
+	details, ok := r.GetStreamDetails(key)
+	if !ok {
+		return nil, ErrExpired
+	}
+
+	r.mutex.RLock()
+	channel, ok := r.senders[key]
+	expired := r.expired[key]
+	r.mutex.RUnlock()
+	if !ok {
+		return nil, ErrExpired
+	}
+
+	timeout := time.NewTimer(time.Until(details.Expires))
+	defer timeout.Stop()
+
+	select {
+	case stream := <-channel:
+		return &stream, nil
+	case <-timeout.C:
+		return nil, ErrExpired
+	case <-expired:
+		return nil, ErrExpired
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (r *MemoryRegistry) GetStreamDetails(key string) (*StreamDetails, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	value, ok := r.streamDetails[key]
+	if !ok || time.Now().After(value.Expires) {
+		return nil, false
+	}
+	details := *value
+
+	return &details, true
+}
+
+func (r *MemoryRegistry) IsLocal(key string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	_, ok := r.streamDetails[key]
+	return ok
+}
+
+func (r *MemoryRegistry) SetStatus(key string, status Status) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if details, ok := r.streamDetails[key]; ok {
+		details.Status = status
+		r.notify(key)
+	}
+}
+
+func (r *MemoryRegistry) SetUploaded(key string, uploaded int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if details, ok := r.streamDetails[key]; ok {
+		details.Uploaded = uploaded
+		r.notify(key)
+	}
+}
+
+func (r *MemoryRegistry) SetChecksum(key string, checksum string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if details, ok := r.streamDetails[key]; ok {
+		details.Checksum = checksum
+		r.notify(key)
+	}
+}
+
+func (r *MemoryRegistry) CompleteDownload(key string) {
+	r.mutex.Lock()
+	details, ok := r.streamDetails[key]
+	if !ok {
+		r.mutex.Unlock()
+		return
+	}
+	details.Downloads++
+	retired := details.DownloadsLeft() == 0
+	r.notify(key)
+	r.mutex.Unlock()
+
+	if retired {
+		r.DeleteStream(key)
+	}
+}
+
+func (r *MemoryRegistry) Subscribe(key string) (<-chan StreamDetails, func(), bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	details, ok := r.streamDetails[key]
+	if !ok {
+		return nil, nil, false
+	}
+
+	subscriber := make(chan StreamDetails, 1)
+	subscriber <- *details
+	r.subscribers[key] = append(r.subscribers[key], subscriber)
+
+	unsubscribe := func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+
+		for i, existing := range r.subscribers[key] {
+			if existing == subscriber {
+				r.subscribers[key] = append(r.subscribers[key][:i], r.subscribers[key][i+1:]...)
+				break
+			}
+		}
+		if len(r.subscribers[key]) == 0 {
+			delete(r.subscribers, key)
+		}
+	}
+
+	return subscriber, unsubscribe, true
+}
+
+// notify sends the details of a transfer to its subscribers, it has to be
+// called with the mutex held. Slow subscribers only get the latest details.
+func (r *MemoryRegistry) notify(key string) {
+	details := *r.streamDetails[key]
+	if r.onChange != nil {
+		r.onChange(details)
+	}
+
+	for _, subscriber := range r.subscribers[key] {
+		select {
+		case <-subscriber:
+		default:
+		}
+		subscriber <- details
+	}
+}
+
+func (r *MemoryRegistry) StoreSpool(ctx context.Context, key string, reader io.Reader, size int64, spool *Spool) error {
+	stored, storedSize := reader, size
+	if spoolKey := r.spoolKey(key); spoolKey != nil {
+		sealed := sealSpool(reader, spoolKey)
+		defer sealed.Close()
+
+		stored, storedSize = sealed, seal.SealedSize(size)
+	}
+	if err := r.store.Put(ctx, key, stored, storedSize); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	r.spools[key] = spool
+	if ready, ok := r.spoolReady[key]; ok {
+		close(ready)
+		delete(r.spoolReady, key)
+	}
+	if details, ok := r.streamDetails[key]; ok {
+		details.Status = StatusCompleted
+		details.Size = size
+		details.Uploaded = size
+		details.Checksum = spool.Checksum
+		r.notify(key)
+	}
+	r.mutex.Unlock()
+
+	details, ok := r.GetStreamDetails(key)
+	if !ok {
+		r.DeleteStream(key)
+		return nil
+	}
+
+	time.AfterFunc(time.Until(details.Expires), func() {
+		r.DeleteStream(key)
+	})
+
+	return nil
+}
+
+func (r *MemoryRegistry) GetSpool(key string) (*Spool, bool) {
+	if _, ok := r.GetStreamDetails(key); !ok {
+		return nil, false
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	spool, ok := r.spools[key]
+
+	return spool, ok
+}
+
+func (r *MemoryRegistry) OpenSpool(ctx context.Context, key string) (storage.Object, *Spool, error) {
+	spool, ok := r.GetSpool(key)
+	if !ok {
+		return nil, nil, storage.ErrNotFound
+	}
+
+	object, err := r.store.Open(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if spoolKey := r.spoolKey(key); spoolKey != nil {
+		seeker, err := seal.NewSeeker(object, object.Size(), spoolKey)
+		if err != nil {
+			object.Close()
+			return nil, nil, err
+		}
+		return &sealedObject{Seeker: seeker, object: object}, spool, nil
+	}
+
+	return object, spool, nil
+}
+
+func (r *MemoryRegistry) spoolKey(key string) []byte {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if details, ok := r.streamDetails[key]; ok {
+		return details.SpoolKey
+	}
+
+	return nil
+}
+
+// sealSpool encrypts the upload on its way into storage.
+func sealSpool(reader io.Reader, spoolKey []byte) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		writer, err := seal.NewWriter(pw, spoolKey)
+		if err == nil {
+			_, err = io.Copy(writer, reader)
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+// sealedObject decrypts a spool sealed at rest.
+type sealedObject struct {
+	*seal.Seeker
+	object storage.Object
+}
+
+func (o *sealedObject) Close() error {
+	return o.object.Close()
+}
+
+func (o *sealedObject) ModTime() time.Time {
+	return o.object.ModTime()
+}
+
+func (r *MemoryRegistry) DeleteStream(key string) {
+	r.mutex.Lock()
+	var deleted *StreamDetails
+	if details, ok := r.streamDetails[key]; ok {
+		details.Status = StatusExpired
+		r.notify(key)
+		snapshot := *details
+		deleted = &snapshot
+	}
+	for _, subscriber := range r.subscribers[key] {
+		close(subscriber)
+	}
+	delete(r.subscribers, key)
+	delete(r.streamDetails, key)
+	delete(r.streamings, key)
+	delete(r.senders, key)
+	if expired, ok := r.expired[key]; ok {
+		close(expired)
+		delete(r.expired, key)
+	}
+	delete(r.returned, key)
+	if ready, ok := r.spoolReady[key]; ok {
+		close(ready)
+		delete(r.spoolReady, key)
+	}
+	_, spooled := r.spools[key]
+	delete(r.spools, key)
+	callbacks := r.onDelete
+	r.mutex.Unlock()
+
+	if deleted != nil {
+		for _, callback := range callbacks {
+			callback(*deleted)
+		}
+	}
+
+	if !spooled {
+		return
+	}
+	if err := r.store.Delete(context.Background(), key); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+func (r *MemoryRegistry) Purge(ctx context.Context, before time.Time) (int, int, error) {
+	now := time.Now()
+
+	r.mutex.RLock()
+	var expired []string
+	for key, details := range r.streamDetails {
+		if now.After(details.Expires) {
+			expired = append(expired, key)
+		}
+	}
+	r.mutex.RUnlock()
+
+	for _, key := range expired {
+		r.DeleteStream(key)
+	}
+
+	purger, ok := r.store.(storage.Purger)
+	if !ok {
+		return len(expired), 0, nil
+	}
+	spools, err := purger.Purge(ctx, r.IsLocal, before)
+
+	return len(expired), spools, err
+}
+
+func (r *MemoryRegistry) OnDelete(callback func(details StreamDetails)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.onDelete = append(r.onDelete, callback)
+}
@@ -1,71 +1,131 @@
 package tunnel
 
 import (
-	"net/http"
-	"sync"
+	"errors"
+	"io"
+	"strings"
 	"time"
+	"trisend/internal/archive"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
+// ErrExpired is returned when a link expires before a recipient shows up.
+var ErrExpired = errors.New("stream expired")
+
 type Stream struct {
-	Writer http.ResponseWriter
-	Done   chan struct{}
-	Error  chan struct{}
+	Done  chan struct{}
+	Error chan struct{}
+	// Format is the archive format the recipient asked for.
+	Format archive.Format
+	// Relay lets a sender write the upload straight to the recipient
+	// instead of spooling it. It writes the response headers described by
+	// spool and returns the response body.
+	Relay func(spool *Spool) io.Writer
 }
 
-var (
-	streamings    = map[string]chan Stream{}
-	streamDetails sync.Map
-	mutex         sync.RWMutex
+type Visibility string
+
+const (
+	// VisibilityPrivate transfers require a Trisend account.
+	VisibilityPrivate Visibility = "private"
+	// VisibilityPublic transfers can be downloaded by anyone with the link.
+	VisibilityPublic Visibility = "public"
+	// VisibilityPassword transfers can be downloaded by anyone with the
+	// link after entering the password chosen by the sender.
+	VisibilityPassword Visibility = "password"
 )
 
-type StreamDetails struct {
-	Username string
-	Pfp      string
-	Filename string
-	Expires  time.Time
-}
+// Status is the state of a transfer shown to recipients.
+type Status string
 
-func SetStream(key string, stream chan Stream, value *StreamDetails) {
-	streamDetails.Store(key, value)
+const (
+	// StatusWaiting transfers have a sender waiting for a recipient to
+	// start the download.
+	StatusWaiting Status = "waiting"
+	// StatusUploading transfers are being sent.
+	StatusUploading Status = "uploading"
+	// StatusCompleted transfers have been fully uploaded.
+	StatusCompleted Status = "completed"
+	// StatusExpired transfers can not be downloaded anymore.
+	StatusExpired Status = "expired"
+)
 
-	mutex.Lock()
-	defer mutex.Unlock()
-	streamings[key] = stream
+type StreamDetails struct {
+	ID string
+	// Node is the instance the sender is connected to, empty when the
+	// transfers are not shared between instances.
+	Node         string
+	UserID       string
+	Username     string
+	Pfp          string
+	Filename     string
+	Message      string
+	Expires      time.Time
+	MaxDownloads int
+	Downloads    int
+	// Recipients restricts the download to these usernames or emails,
+	// anyone can download when it is empty.
+	Recipients []string
+	Visibility Visibility
+	// PasswordHash is shared with the other instances under its own key,
+	// it is never published to the subscribers of the transfer.
+	PasswordHash []byte `json:"-"`
+	Status       Status
+	// Uploaded is the amount of bytes received from the sender so far.
+	Uploaded int64
+	// Size is the size of the upload, 0 while it is not known.
+	Size int64
+	// Sealed uploads were encrypted by the sender, recipients decrypt them
+	// with the key in the fragment of the link.
+	Sealed bool
+	// SpoolKey encrypts the temp files and the spool of the upload at rest.
+	// It is only kept in memory, so whatever a crash leaves behind can not
+	// be read anymore, instances drop the transfers of their previous run.
+	SpoolKey []byte `json:"-"`
+	// Checksum is the hex SHA-256 of what recipients download, empty until
+	// the upload is complete.
+	Checksum string
 }
 
-func GetStream(key string) (chan Stream, bool) {
-	details, ok := GetStreamDetails(key)
-	if !ok {
-		return nil, ok
-	} else if time.Now().After(details.Expires) {
-		return nil, false
-	}
-
-	mutex.Lock()
-	defer mutex.Unlock()
-	stream, ok := streamings[key]
+// RequiresAccount reports whether only logged in users can download.
+func (details *StreamDetails) RequiresAccount() bool {
+	return details.Visibility == VisibilityPrivate
+}
 
-	return stream, ok
+func (details *StreamDetails) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword(details.PasswordHash, []byte(password)) == nil
 }
 
-func GetStreamDetails(key string) (*StreamDetails, bool) {
-	value, ok := streamDetails.Load(key)
-	if !ok {
-		return nil, ok
+func (details *StreamDetails) CanDownload(username, email string) bool {
+	if len(details.Recipients) == 0 {
+		return true
 	}
 
-	details := value.(*StreamDetails)
-	if time.Now().After(details.Expires) {
-		return nil, false
+	for _, recipient := range details.Recipients {
+		if strings.EqualFold(recipient, username) || strings.EqualFold(recipient, email) {
+			return true
+		}
 	}
 
-	return details, ok
+	return false
 }
 
-func DeleteStream(key string) {
-	streamDetails.Delete(key)
+// DownloadsLeft returns how many more times the transfer can be downloaded.
+func (details *StreamDetails) DownloadsLeft() int {
+	return max(details.MaxDownloads-details.Downloads, 0)
+}
 
-	mutex.Lock()
-	defer mutex.Unlock()
-	delete(streamings, key)
+// Spool describes an upload kept in storage. It stays there until the
+// stream expires so recipients can resume interrupted downloads.
+type Spool struct {
+	Filename    string
+	ContentType string
+	// Format is the archive format of the upload, empty for a single file
+	// sent as is.
+	Format archive.Format
+	// Checksum is the hex SHA-256 of the spooled file. The sender of a
+	// relayed upload sets it on the spool passed to Relay before Done is
+	// closed, it is only known once everything was written.
+	Checksum string
 }
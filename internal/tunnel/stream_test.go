@@ -1,25 +1,80 @@
 package tunnel
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+	"trisend/internal/seal"
+	"trisend/internal/storage"
+)
+
+// newTestRegistry mirrors tunneltest.NewRegistry, which the tests of this
+// package can not import.
+func newTestRegistry(t *testing.T) *MemoryRegistry {
+	t.Helper()
+
+	store, err := storage.NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewMemoryRegistry(store)
+}
+
+func testDetails() *StreamDetails {
+	return &StreamDetails{Expires: time.Now().Add(time.Minute)}
+}
 
 func TestSetStream(t *testing.T) {
+	registry := newTestRegistry(t)
 	key := "testKey"
 	stream := make(chan Stream)
 
-	SetStream(key, stream)
+	registry.SetStream(key, stream, testDetails())
 
-	if _, ok := GetStream(key); !ok {
+	if _, ok := registry.GetStream(key); !ok {
 		t.Errorf("expected stream to be set for key %s, but it was not found", key)
 	}
 }
 
+func TestSetStreamCopiesDetails(t *testing.T) {
+	registry := newTestRegistry(t)
+
+	// the sessions of one ssh connection start from the same details
+	details := testDetails()
+	registry.SetStream("first", nil, details)
+	registry.SetStream("second", make(chan Stream), details)
+	details.Filename = "changed.txt"
+
+	if details.ID != "" || details.Status != "" {
+		t.Errorf("expected the details of the caller to be left alone, got %q %q", details.ID, details.Status)
+	}
+	first, _ := registry.GetStreamDetails("first")
+	second, _ := registry.GetStreamDetails("second")
+	if first.ID != "first" || second.ID != "second" || first.Status == second.Status {
+		t.Errorf("expected each transfer to keep its own details, got %+v and %+v", first, second)
+	}
+	if first.Filename != "" {
+		t.Errorf("expected later changes of the caller to be ignored, got %q", first.Filename)
+	}
+
+	first.Filename = "changed.txt"
+	if again, _ := registry.GetStreamDetails("first"); again.Filename != "" {
+		t.Errorf("expected a copy of the details, got %q", again.Filename)
+	}
+}
+
 func TestGetStream(t *testing.T) {
+	registry := newTestRegistry(t)
 	key := "testKey"
 	streamChan := make(chan Stream)
 
-	SetStream(key, streamChan)
+	registry.SetStream(key, streamChan, testDetails())
 
-	retrievedChan, ok := GetStream(key)
+	retrievedChan, ok := registry.GetStream(key)
 	if !ok {
 		t.Fatalf("expected to retrieve a stream for key %s, but it was not found", key)
 	}
@@ -29,21 +84,191 @@ func TestGetStream(t *testing.T) {
 	}
 }
 
+func TestWaitStreamTakesReturnedStream(t *testing.T) {
+	registry := newTestRegistry(t)
+	key := "testKey"
+	streamChan := make(chan Stream)
+	registry.SetStream(key, streamChan, testDetails())
+
+	first, err := registry.WaitStream(context.Background(), key)
+	if err != nil || first != streamChan {
+		t.Fatalf("expected the first recipient to take the stream, got %v", err)
+	}
+
+	taken := make(chan chan Stream, 1)
+	go func() {
+		channel, _ := registry.WaitStream(context.Background(), key)
+		taken <- channel
+	}()
+
+	// the first recipient gives up before the sender picked its request up
+	registry.ReturnStream(key, first)
+
+	select {
+	case channel := <-taken:
+		if channel != streamChan {
+			t.Errorf("expected the waiting recipient to take the returned stream")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the waiting recipient to be woken up")
+	}
+}
+
 func TestDeleteStream(t *testing.T) {
+	registry := newTestRegistry(t)
 	key := "testKey"
 	streamChan := make(chan Stream)
 
-	SetStream(key, streamChan)
-	DeleteStream(key)
+	registry.SetStream(key, streamChan, testDetails())
+	registry.DeleteStream(key)
 
-	if _, ok := GetStream(key); ok {
+	if _, ok := registry.GetStream(key); ok {
 		t.Errorf("expected stream for key %s to be deleted, but it was found", key)
 	}
 }
 
 func TestGetStreamNotFound(t *testing.T) {
+	registry := newTestRegistry(t)
 	key := "nonExistentKey"
-	if _, ok := GetStream(key); ok {
+	if _, ok := registry.GetStream(key); ok {
 		t.Errorf("expected no stream for key \"%s\", but found one", key)
 	}
 }
+
+func TestWaitRecipient(t *testing.T) {
+	registry := newTestRegistry(t)
+	key := "testKey"
+	streamChan := make(chan Stream)
+	registry.SetStream(key, streamChan, testDetails())
+
+	go func() {
+		channel, _ := registry.TakeStream(key)
+		channel <- Stream{Done: make(chan struct{})}
+	}()
+
+	stream, err := registry.WaitRecipient(context.Background(), key)
+	if err != nil || stream.Done == nil {
+		t.Fatalf("expected the stream of the recipient, got %v %v", stream, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	registry.SetStream("other", make(chan Stream), testDetails())
+	if _, err := registry.WaitRecipient(ctx, "other"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the wait to stop with the context, got %v", err)
+	}
+}
+
+func TestCompleteDownloadRetiresSpool(t *testing.T) {
+	registry := newTestRegistry(t)
+	key := "testKey"
+	details := testDetails()
+	details.MaxDownloads = 2
+	registry.SetStream(key, nil, details)
+
+	data := []byte("hello")
+	if err := registry.StoreSpool(context.Background(), key, bytes.NewReader(data), int64(len(data)), &Spool{Filename: "hello.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	events, unsubscribe, ok := registry.Subscribe(key)
+	if !ok {
+		t.Fatalf("expected to subscribe to %s", key)
+	}
+	defer unsubscribe()
+	if current := <-events; current.Status != StatusCompleted {
+		t.Errorf("expected a completed transfer, got %s", current.Status)
+	}
+
+	registry.CompleteDownload(key)
+	if _, ok := registry.GetSpool(key); !ok {
+		t.Fatalf("expected the spool to be kept after the first download")
+	}
+
+	registry.CompleteDownload(key)
+	if _, ok := registry.GetSpool(key); ok {
+		t.Errorf("expected the spool to be deleted after the last download")
+	}
+	if current := <-events; current.Status != StatusExpired {
+		t.Errorf("expected an expired transfer, got %s", current.Status)
+	}
+}
+
+func TestSpoolSealedAtRest(t *testing.T) {
+	registry := newTestRegistry(t)
+	ctx := context.Background()
+
+	details := testDetails()
+	details.SpoolKey, _ = seal.NewKey()
+	registry.SetStream("testKey", nil, details)
+
+	data := []byte("hello world")
+	if err := registry.StoreSpool(ctx, "testKey", bytes.NewReader(data), int64(len(data)), &Spool{}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := registry.store.Open(ctx, "testKey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(stored)
+	stored.Close()
+	if bytes.Contains(raw, data) {
+		t.Error("expected the spool to be encrypted in storage")
+	}
+
+	object, _, err := registry.OpenSpool(ctx, "testKey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer object.Close()
+	if object.Size() != int64(len(data)) {
+		t.Errorf("expected the size of the plaintext, got %d", object.Size())
+	}
+	if opened, _ := io.ReadAll(object); !bytes.Equal(opened, data) {
+		t.Errorf("expected %q, got %q", data, opened)
+	}
+}
+
+func TestDeleteStreamWakesSender(t *testing.T) {
+	registry := newTestRegistry(t)
+	registry.SetStream("testKey", make(chan Stream), testDetails())
+
+	go registry.DeleteStream("testKey")
+
+	if _, err := registry.WaitRecipient(context.Background(), "testKey"); !errors.Is(err, ErrExpired) {
+		t.Errorf("expected ErrExpired, got %v", err)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	registry := newTestRegistry(t)
+	store := registry.store
+	ctx := context.Background()
+
+	registry.SetStream("active", nil, testDetails())
+	registry.StoreSpool(ctx, "active", bytes.NewReader([]byte("kept")), 4, &Spool{})
+	registry.SetStream("expired", nil, &StreamDetails{Expires: time.Now().Add(-time.Second)})
+	// left behind by a previous run
+	store.Put(ctx, "orphan", bytes.NewReader([]byte("gone")), 4)
+
+	streams, spools, err := registry.Purge(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streams != 1 || spools != 1 {
+		t.Errorf("expected 1 stream and 1 spool purged, got %d and %d", streams, spools)
+	}
+
+	if registry.IsLocal("expired") {
+		t.Error("expected expired stream to be evicted")
+	}
+	if _, err := store.Open(ctx, "orphan"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected orphaned spool to be deleted, got %v", err)
+	}
+	object, _, err := registry.OpenSpool(ctx, "active")
+	if err != nil {
+		t.Fatalf("expected active spool to be kept, got %v", err)
+	}
+	object.Close()
+}
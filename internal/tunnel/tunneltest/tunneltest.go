@@ -0,0 +1,22 @@
+// Package tunneltest sets up the registry the tests of other packages run
+// their transfers through.
+package tunneltest
+
+import (
+	"testing"
+	"trisend/internal/storage"
+	"trisend/internal/tunnel"
+)
+
+// NewRegistry returns a memory registry spooling uploads to a temp dir that
+// is removed once the test is over.
+func NewRegistry(t testing.TB) *tunnel.MemoryRegistry {
+	t.Helper()
+
+	store, err := storage.NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tunnel.NewMemoryRegistry(store)
+}
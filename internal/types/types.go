@@ -2,6 +2,7 @@ package types
 
 import (
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -24,6 +25,69 @@ type CreateUser struct {
 	Pfp      string
 }
 
+const DefaultPlan = "free"
+
+// Quota limits how much a user can transfer, a zero value means unlimited.
+type Quota struct {
+	MaxFileSize         int64
+	DailyBytes          int64
+	ConcurrentTransfers int
+}
+
+var Plans = map[string]Quota{
+	"free": {
+		MaxFileSize:         5295309, // 5.05MB
+		DailyBytes:          50 << 20,
+		ConcurrentTransfers: 2,
+	},
+	"pro": {
+		MaxFileSize:         1 << 30,
+		DailyBytes:          10 << 30,
+		ConcurrentTransfers: 10,
+	},
+}
+
+// Transfer is the record of a link kept in the history of its sender.
+type Transfer struct {
+	ID       string
+	UserID   string
+	Filename string
+	// Size is the amount uploaded, 0 until the upload is done
+	Size      int64
+	Created   time.Time
+	Expires   time.Time
+	Revoked   bool
+	Downloads []Download
+}
+
+// Download is a completed download of a transfer, Username is empty for
+// recipients without an account.
+type Download struct {
+	Username string
+	At       time.Time
+}
+
+// Notifications are the emails a user opted in to about its transfers.
+type Notifications struct {
+	FirstDownload bool
+	EveryDownload bool
+	Expired       bool
+	// Inbox is about transfers sent to the user.
+	Inbox bool
+}
+
+// TransferMail is rendered into the notification emails about a transfer.
+type TransferMail struct {
+	Host     string
+	Title    string
+	Message  string
+	Filename string
+	Link     string
+	// Action is the label of an optional button leading to ActionLink.
+	Action     string
+	ActionLink string
+}
+
 type TransitSess struct {
 	ID    string
 	Email string
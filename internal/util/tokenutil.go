@@ -11,6 +11,14 @@ import (
 
 var invalidToken = fmt.Errorf("invalid token")
 
+// DOWNLOAD_COOKIE prefixes the id of a transfer in the name of the cookie
+// holding its download token.
+const DOWNLOAD_COOKIE = "download_"
+
+// nodeTokenExpiry only covers the request another instance makes right
+// after authorizing the recipient.
+const nodeTokenExpiry = time.Minute
+
 func CreateAccessToken(user types.Session, expiry int) (string, error) {
 	exp := time.Now().Add(time.Hour * time.Duration(expiry))
 	claims := &types.JwtSessClaims{
@@ -36,6 +44,30 @@ func CreateSignupToken(id string, email string, expiry int) (string, error) {
 	return createToken(claims)
 }
 
+// CreateDownloadToken grants access to a password protected transfer.
+func CreateDownloadToken(id string, expires time.Time) (string, error) {
+	claims := jwt.MapClaims{
+		"download": id,
+		"exp":      jwt.NewNumericDate(expires),
+	}
+
+	return createToken(claims)
+}
+
+// CreateNodeToken lets another instance download the transfer on behalf of
+// a recipient it authorized already, it grants nothing else.
+func CreateNodeToken(id string, user types.Session) (string, error) {
+	claims := jwt.MapClaims{
+		"download": id,
+		"id":       user.ID,
+		"username": user.Username,
+		"email":    user.Email,
+		"exp":      jwt.NewNumericDate(time.Now().Add(nodeTokenExpiry)),
+	}
+
+	return createToken(claims)
+}
+
 func createToken(claims jwt.Claims) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	tokenString, err := token.SignedString([]byte(config.JWT_SECRET))
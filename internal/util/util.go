@@ -8,6 +8,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func GetRandomID(size int) string {
@@ -57,3 +58,53 @@ func GetEnvInt(name string, callback int) int {
 
 	return converted
 }
+
+func FormatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.2f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// FormatDuration renders a duration in words, e.g. "1 hour 30 minutes".
+func FormatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	units := []struct {
+		name string
+		size time.Duration
+	}{
+		{"day", time.Hour * 24},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+		{"second", time.Second},
+	}
+
+	parts := []string{}
+	for _, unit := range units {
+		amount := d / unit.size
+		if amount == 0 {
+			continue
+		}
+		d -= amount * unit.size
+
+		part := fmt.Sprintf("%d %s", amount, unit.name)
+		if amount > 1 {
+			part += "s"
+		}
+		parts = append(parts, part)
+	}
+
+	if len(parts) == 0 {
+		return "0 seconds"
+	}
+
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,124 @@
+// Opens sealed transfers in the browser with the key in the fragment of the
+// link, which is never sent to the server. It mirrors internal/seal: a magic,
+// a nonce prefix and AES-256-GCM chunks whose nonce is the prefix, the index
+// of the chunk and a byte marking the last one.
+(function() {
+	const MAGIC = 'TRISEAL1'
+	const PREFIX_SIZE = 7
+	const HEADER_SIZE = MAGIC.length + PREFIX_SIZE
+	const CHUNK_SIZE = 64 * 1024
+	const SEALED_CHUNK_SIZE = CHUNK_SIZE + 16
+
+	const importKey = (encoded) => {
+		const base64 = encoded.replace(/-/g, '+').replace(/_/g, '/')
+		const raw = Uint8Array.from(atob(base64), (c) => c.charCodeAt(0))
+		if (raw.length !== 32) {
+			throw new Error('invalid key')
+		}
+		return crypto.subtle.importKey('raw', raw, 'AES-GCM', false, ['decrypt'])
+	}
+
+	const chunkNonce = (prefix, index, last) => {
+		const nonce = new Uint8Array(PREFIX_SIZE + 5)
+		nonce.set(prefix)
+		new DataView(nonce.buffer).setUint32(PREFIX_SIZE, index)
+		nonce[PREFIX_SIZE + 4] = last ? 1 : 0
+		return nonce
+	}
+
+	const concat = (a, b) => {
+		const joined = new Uint8Array(a.length + b.length)
+		joined.set(a)
+		joined.set(b, a.length)
+		return joined
+	}
+
+	// open decrypts the body of the response chunk by chunk while it arrives
+	async function open(response, key, onProgress) {
+		const reader = response.body.getReader()
+		const parts = []
+		let buffer = new Uint8Array(0)
+		let prefix = null
+		let index = 0
+		let received = 0
+
+		const openChunk = async (chunk, last) => {
+			const iv = chunkNonce(prefix, index++, last)
+			parts.push(await crypto.subtle.decrypt({ name: 'AES-GCM', iv }, key, chunk))
+		}
+
+		for (;;) {
+			const { done, value } = await reader.read()
+			if (value) {
+				buffer = concat(buffer, value)
+				received += value.length
+				onProgress(received)
+			}
+
+			if (!prefix && buffer.length >= HEADER_SIZE) {
+				if (new TextDecoder().decode(buffer.subarray(0, MAGIC.length)) !== MAGIC) {
+					throw new Error('not sealed')
+				}
+				prefix = buffer.slice(MAGIC.length, HEADER_SIZE)
+				buffer = buffer.slice(HEADER_SIZE)
+			}
+			// a full chunk is only the last one when nothing follows it
+			while (prefix && buffer.length > SEALED_CHUNK_SIZE) {
+				await openChunk(buffer.subarray(0, SEALED_CHUNK_SIZE), false)
+				buffer = buffer.slice(SEALED_CHUNK_SIZE)
+			}
+			if (done) {
+				break
+			}
+		}
+
+		if (!prefix) {
+			throw new Error('not sealed')
+		}
+		await openChunk(buffer, true)
+
+		return parts
+	}
+
+	document.addEventListener('DOMContentLoaded', () => {
+		const $button = document.querySelector('#sealed_download')
+		const $message = document.querySelector('#sealed_message')
+		if (!$button) {
+			return
+		}
+
+		const encodedKey = location.hash.slice(1)
+		if (!encodedKey) {
+			$button.disabled = true
+			$message.textContent = 'This link is missing its key, ask the sender for the full link.'
+			return
+		}
+
+		$button.addEventListener('click', async () => {
+			$button.disabled = true
+			try {
+				const key = await importKey(encodedKey)
+				const response = await fetch($button.dataset.url)
+				if (!response.ok) {
+					throw new Error('download failed')
+				}
+
+				const parts = await open(response, key, (received) => {
+					$message.textContent = `Decrypting, ${Math.round(received / 1024)} KiB received`
+				})
+
+				const link = document.createElement('a')
+				link.href = URL.createObjectURL(new Blob(parts))
+				link.download = $button.dataset.filename
+				link.click()
+				URL.revokeObjectURL(link.href)
+				$message.textContent = 'Decrypted in your browser.'
+			} catch (err) {
+				$message.textContent = err.name === 'OperationError'
+					? 'The file could not be decrypted, the key in the link is wrong or the file was altered.'
+					: 'The file could not be downloaded, try it later.'
+			}
+			$button.disabled = false
+		})
+	})
+})()